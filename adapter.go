@@ -15,29 +15,167 @@
 package mongodbadapter
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/casbin/casbin/model"
 	"github.com/casbin/casbin/persist"
 	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
 )
 
-// CasbinRule represents a rule in Casbin.
+// defaultDatabaseName is the database holding the rules when neither the URL
+// nor WithDatabaseName names one.
+const defaultDatabaseName = "casbin"
+
+// defaultCollectionName is the collection holding the rules unless
+// WithCollectionName says otherwise. It is never derived from the database
+// name.
+const defaultCollectionName = "casbin_rule"
+
+// codeNamespaceExists is the server error code for an already existing
+// collection.
+const codeNamespaceExists = 48
+
+// codeNamespaceNotFound is the server error code for a missing collection.
+const codeNamespaceNotFound = 26
+
+// isNamespaceNotFound reports whether err means that the collection an
+// operation applies to does not exist. Servers which do not report the error
+// code are recognized by their message.
+func isNamespaceNotFound(err error) bool {
+	if qerr, ok := err.(*mgo.QueryError); ok && qerr.Code == codeNamespaceNotFound {
+		return true
+	}
+	return err != nil && err.Error() == "ns not found"
+}
+
+// dropCollection drops c, which does not have to exist.
+func dropCollection(c *mgo.Collection) error {
+	if err := c.DropCollection(); err != nil && !isNamespaceNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+// ErrCollectionNotFound is returned by LoadPolicy when the collection does
+// not exist and WithRequireCollection is used.
+var ErrCollectionNotFound = errors.New("mongodbadapter: collection not found")
+
+// ErrTooManyRules is returned by LoadPolicy when the collection holds more
+// rules than allowed by SetMaxLoadCount.
+var ErrTooManyRules = errors.New("mongodbadapter: too many rules to load")
+
+// CasbinRule represents a rule in Casbin. Values beyond the sixth one are
+// stored in order in VExtra, which is left out of documents with no more than
+// six values.
+//
+// The field names are spelled out rather than left to mgo's lowercasing so
+// that they keep matching the selectors, which name them explicitly, whatever
+// the driver.
 type CasbinRule struct {
-	PType string
-	V0    string
-	V1    string
-	V2    string
-	V3    string
-	V4    string
-	V5    string
+	ID     bson.ObjectId `bson:"_id,omitempty"`
+	PType  string        `bson:"ptype"`
+	V0     string        `bson:"v0"`
+	V1     string        `bson:"v1"`
+	V2     string        `bson:"v2"`
+	V3     string        `bson:"v3"`
+	V4     string        `bson:"v4"`
+	V5     string        `bson:"v5"`
+	VExtra []string      `bson:"vextra,omitempty"`
 }
 
 // adapter represents the MongoDB adapter for policy storage.
 type adapter struct {
 	url        string
+	credential *mgo.Credential
+	pool       PoolOptions
 	session    *mgo.Session
+	ownSession bool
 	collection *mgo.Collection
+
+	// lazyDialInfo is the dial info of an adapter created with
+	// WithLazyConnect, which connect dials on first use under connMu.
+	lazyConnect  bool
+	lazyDialInfo *mgo.DialInfo
+	connMu       sync.Mutex
+
+	databaseName   string
+	collectionName string
+	archiveName    string
+	archive        *mgo.Collection
+
+	skipUnknownPTypes bool
+	uniqueIndex       bool
+	ignoreDuplicates  bool
+	maxLoadCount      int
+	idFactory         func() bson.ObjectId
+	codec             Codec
+	fieldNames        map[string]string
+	atomicSave        bool
+	pingOnOpen        bool
+	collectionInfo    *mgo.CollectionInfo
+	middleware        []Middleware
+
+	checksumKey          []byte
+	skipInvalidChecksums bool
+	requireCollection    bool
+	projection           bson.M
+	addBuffer            *addBuffer
+	loadSort             []string
+	loadBatchSize        int
+	strictArity          bool
+	watchBackoff         WatchBackoff
+	retryPolicy          RetryPolicy
+	changeHook           func(PolicyChange)
+	metrics              Metrics
+	upsertKey            []int
+	timestamps           bool
+	ttlIndex             bool
+	fallbackCodecs       []Codec
+	timeout              time.Duration
+	indexes              []mgo.Index
+	skipIndexCreation    bool
+	indexOptions         IndexOptions
+	collation            *mgo.Collation
+	writeConcern         *mgo.Safe
+	loadMode             *mgo.Mode
+
+	life       lifecycle
+	isFiltered bool
+}
+
+// ruleIndex is the index created by default. Its keys follow the order of
+// the rule fields, so that it serves every query on the policy type and a
+// prefix of the values, as issued by RemoveFilteredPolicy with a zero field
+// index, GetPoliciesForSubjects or RolesForUser. Older versions created
+// single-field indexes on each of ptype and v0 to v5 instead, which are left
+// in place on existing collections.
+var ruleIndex = mgo.Index{
+	Key: []string{"ptype", "v0", "v1", "v2", "v3", "v4", "v5"},
+}
+
+// uniqueRuleIndex is the unique partial index created by WithUniqueIndex.
+// Empty values are stored as "", so rules of different lengths sharing a
+// prefix still differ in their trailing fields and never collide. The
+// partial filter limits the constraint to documents that actually hold a
+// rule (non-empty ptype and v0); anything else in the collection, e.g.
+// documents written by other tools, is left unconstrained.
+var uniqueRuleIndex = mgo.Index{
+	Name:   "unique_rule",
+	Key:    []string{"ptype", "v0", "v1", "v2", "v3", "v4", "v5"},
+	Unique: true,
+	PartialFilter: bson.M{
+		"ptype": bson.M{"$gt": ""},
+		"v0":    bson.M{"$gt": ""},
+	},
 }
 
 // finalizer is the destructor for adapter.
@@ -45,47 +183,293 @@ func finalizer(a *adapter) {
 	a.close()
 }
 
-// NewAdapter is the constructor for Adapter. If database name is not provided
-// in the Mongo URL, 'casbin' will be used as database name.
-func NewAdapter(url string) persist.Adapter {
-	a := &adapter{url: url}
+// NewAdapter is the constructor for Adapter. The rules are stored in the
+// "casbin_rule" collection of the database named by the Mongo URL, e.g. "abc"
+// for "127.0.0.1:27017/abc", or of the 'casbin' database if the URL names
+// none. WithDatabaseName picks another database regardless of the URL. It
+// panics if the adapter cannot be opened; use NewAdapterWithError to handle
+// that case.
+func NewAdapter(url string, opts ...Option) persist.Adapter {
+	a, err := NewAdapterWithError(url, opts...)
+	if err != nil {
+		panic(err)
+	}
+	return a
+}
+
+// NewAdapterWithError is like NewAdapter but returns an error instead of
+// panicking when the URL is invalid, the server cannot be reached or the
+// collection cannot be set up.
+//
+// Dialing a URL fails fast, and a server that cannot be reached yields an
+// error matching ErrUnreachable or ErrTimeout with errors.Is. Services which
+// may start before MongoDB is reachable can use WithLazyConnect to create
+// the adapter without connecting.
+func NewAdapterWithError(url string, opts ...Option) (persist.Adapter, error) {
+	a := &adapter{url: url, codec: DefaultCodec}
+	a.apply(opts)
 
+	dI, err := a.dialInfo()
+	if err != nil {
+		return nil, err
+	}
 	// Open the DB, create it if not existed.
-	a.open()
+	if err := a.openOrDefer(dI); err != nil {
+		return nil, err
+	}
 
 	// Call the destructor when the object is released.
 	runtime.SetFinalizer(a, finalizer)
 
+	return a, nil
+}
+
+// NewAdapterWithDialInfo is the constructor for Adapter that dials MongoDB
+// with the given dial info rather than a URL. It gives full control over the
+// connection, e.g. to connect to an explicit list of hosts where
+// "mongodb+srv://" URLs cannot be used (mgo does not resolve them at all):
+//
+//	info := &mgo.DialInfo{
+//		Addrs:          []string{"shard-00.example.net:27017", "shard-01.example.net:27017"},
+//		ReplicaSetName: "rs0",
+//		Source:         "admin",
+//		Username:       "user",
+//		Password:       "secret",
+//		Timeout:        10 * time.Second,
+//		DialServer: func(addr *mgo.ServerAddr) (net.Conn, error) {
+//			return tls.Dial("tcp", addr.String(), &tls.Config{})
+//		},
+//	}
+//	a := mongodbadapter.NewAdapterWithDialInfo(info)
+//
+// An SRV record implies TLS and its TXT record usually carries the
+// replicaSet and authSource options, so when replacing one with its resolved
+// hosts all three have to be set explicitly as above. If info.Database is
+// empty, 'casbin' will be used as database name. It panics if the adapter
+// cannot be opened; use NewAdapterWithDialInfoAndError to handle that case.
+func NewAdapterWithDialInfo(info *mgo.DialInfo, opts ...Option) persist.Adapter {
+	a, err := NewAdapterWithDialInfoAndError(info, opts...)
+	if err != nil {
+		panic(err)
+	}
 	return a
 }
 
+// NewAdapterWithDialInfoAndError is like NewAdapterWithDialInfo but returns
+// an error instead of panicking when the server cannot be reached or the
+// collection cannot be set up.
+func NewAdapterWithDialInfoAndError(info *mgo.DialInfo, opts ...Option) (persist.Adapter, error) {
+	a := &adapter{codec: DefaultCodec}
+	a.apply(opts)
+
+	if err := a.openOrDefer(info); err != nil {
+		return nil, err
+	}
+
+	runtime.SetFinalizer(a, finalizer)
+
+	return a, nil
+}
+
 // NewAdapterWithDB is the constructor for Adapter that uses an already
-// existing Mongo DB connection.
-func NewAdapterWithDB(thedb *mgo.Database) persist.Adapter {
-	a := &adapter{session: thedb.Session}
-	a.openWithDB(thedb)
+// existing Mongo DB connection. It panics if the collection cannot be set
+// up; use NewAdapterWithDBAndError to handle that case.
+func NewAdapterWithDB(thedb *mgo.Database, opts ...Option) persist.Adapter {
+	a, err := NewAdapterWithDBAndError(thedb, opts...)
+	if err != nil {
+		panic(err)
+	}
+	return a
+}
+
+// NewAdapterWithDBAndError is like NewAdapterWithDB but returns an error
+// instead of panicking when the server cannot be reached, e.g. with
+// WithPing, or the collection cannot be set up.
+func NewAdapterWithDBAndError(thedb *mgo.Database, opts ...Option) (persist.Adapter, error) {
+	a := &adapter{session: thedb.Session, codec: DefaultCodec}
+	a.apply(opts)
+	if err := a.openWithDB(thedb); err != nil {
+		return nil, err
+	}
 
 	//no finalizer as the caller will close its connection
 
-	return a
+	return a, nil
+}
+
+// NewAdapterWithSession is the constructor for Adapter that uses a session
+// configured by the caller, e.g. dialed with custom TLS settings, credentials
+// or pool limits, storing the rules in the given database and collection.
+// Empty names default to "casbin" and "casbin_rule". The session stays owned
+// by the caller: the adapter never closes it.
+func NewAdapterWithSession(session *mgo.Session, dbName, collectionName string, opts ...Option) (persist.Adapter, error) {
+	if dbName == "" {
+		dbName = defaultDatabaseName
+	}
+
+	a := &adapter{session: session, codec: DefaultCodec}
+	a.apply(opts)
+	if collectionName != "" {
+		a.collectionName = collectionName
+	}
+	if err := a.openWithDB(session.DB(dbName)); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *adapter) openWithDB(db *mgo.Database) error {
+	if a.pingOnOpen {
+		if err := db.Session.Ping(); err != nil {
+			return classifyOpenError(err)
+		}
+	}
+
+	name := a.collectionName
+	if name == "" {
+		name = defaultCollectionName
+	}
+	a.collection = db.C(name)
+
+	if a.archiveName != "" {
+		a.archive = db.C(a.archiveName)
+	}
+
+	if a.collectionInfo != nil {
+		if err := createCollection(a.collection, a.collectionInfo); err != nil {
+			return err
+		}
+	}
+
+	return a.ensureIndexes(a.collection)
+}
+
+// createCollection explicitly creates c with the given options. An already
+// existing collection is left as it is.
+func createCollection(c *mgo.Collection, info *mgo.CollectionInfo) error {
+	err := c.Create(info)
+	if qerr, ok := err.(*mgo.QueryError); ok && qerr.Code == codeNamespaceExists {
+		return nil
+	}
+	return err
 }
 
-func (a *adapter) openWithDB(db *mgo.Database) {
-	collection := db.C("casbin_rule")
-	a.collection = collection
+// expectedIndexes returns the indexes the adapter relies on, besides the
+// index on _id.
+func (a *adapter) expectedIndexes() []mgo.Index {
+	var indexes []mgo.Index
+	switch {
+	case a.indexes != nil:
+		indexes = append(indexes, a.indexes...)
+	case !a.uniqueIndex:
+		// The unique index has the same keys and serves the same queries.
+		indexes = append(indexes, a.renameIndex(ruleIndex))
+	}
+
+	if a.uniqueIndex {
+		indexes = append(indexes, a.renameIndex(uniqueRuleIndex))
+	}
 
-	indexes := []string{"ptype", "v0", "v1", "v2", "v3", "v4", "v5"}
-	for _, k := range indexes {
-		if err := a.collection.EnsureIndexKey(k); err != nil {
-			panic(err)
+	if a.timestamps {
+		indexes = append(indexes, mgo.Index{Key: []string{updatedAtField}})
+	}
+	if a.ttlIndex {
+		indexes = append(indexes, ttlIndex)
+	}
+
+	if len(a.loadSort) > 0 {
+		sortIndex := mgo.Index{Key: a.loadSort}
+		for _, index := range indexes {
+			if indexKey(index) == indexKey(sortIndex) {
+				return indexes
+			}
 		}
+		indexes = append(indexes, sortIndex)
 	}
+	return indexes
 }
 
-func (a *adapter) open() {
+// ensureIndexes creates the indexes the adapter relies on in c, unless
+// configured with WithSkipIndexCreation.
+//
+// Before MongoDB 4.2, a foreground index build blocks every operation on the
+// database until it completes, so indexes are built in the background on
+// those servers unless IndexOptions.Foreground is set. MongoDB 4.2 and later
+// only lock at the start and end of any build and ignore the background
+// option, which is therefore left out. When the server version cannot be
+// determined, the option is left out as well.
+//
+// The default rule index is dropped before the unique index replacing it is
+// created, so that collections created without WithUniqueIndex can switch to
+// it: servers older than MongoDB 5.0 refuse two indexes on the same keys.
+func (a *adapter) ensureIndexes(c *mgo.Collection) error {
+	if a.skipIndexCreation {
+		return nil
+	}
+	if a.uniqueIndex && a.indexes == nil {
+		if err := a.dropRuleIndex(c); err != nil {
+			return err
+		}
+	}
+
+	background := false
+	if info, err := c.Database.Session.BuildInfo(); err == nil && !a.indexOptions.Foreground {
+		background = !info.VersionAtLeast(4, 2)
+	}
+
+	for _, index := range a.expectedIndexes() {
+		index.Background = background
+		if index.Collation == nil {
+			index.Collation = a.indexCollation()
+		}
+		if err := c.EnsureIndex(index); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dropRuleIndex drops the non-unique rule index from c, if it has one.
+func (a *adapter) dropRuleIndex(c *mgo.Collection) error {
+	indexes, err := c.Indexes()
+	if isNamespaceNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	key := indexKey(a.renameIndex(ruleIndex))
+	for _, index := range indexes {
+		if !index.Unique && indexKey(index) == key {
+			return c.DropIndexName(index.Name)
+		}
+	}
+	return nil
+}
+
+// ErrMaxStalenessUnsupported is returned by NewAdapterWithError when the URL
+// sets the maxStalenessSeconds option, which the mgo driver does not
+// implement. Secondary reads cannot be bounded by staleness; load policy
+// from the primary if lagging secondaries cannot be tolerated.
+var ErrMaxStalenessUnsupported = errors.New("mongodbadapter: unsupported URL option maxStalenessSeconds: the mgo driver does not implement it")
+
+// dialInfo returns the dial info for the adapter's URL.
+func (a *adapter) dialInfo() (*mgo.DialInfo, error) {
+	// mgo rejects unknown URL options with a generic error, so report this
+	// one explicitly rather than leaving the caller to wonder why a valid
+	// MongoDB URL is refused.
+	if i := strings.IndexByte(a.url, '?'); i >= 0 {
+		for _, opt := range strings.FieldsFunc(a.url[i+1:], func(r rune) bool { return r == '&' || r == ';' }) {
+			if name := strings.SplitN(opt, "=", 2)[0]; strings.EqualFold(name, "maxStalenessSeconds") {
+				return nil, ErrMaxStalenessUnsupported
+			}
+		}
+	}
+
 	dI, err := mgo.ParseURL(a.url)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
 	// FailFast will cause connection and query attempts to fail faster when
@@ -95,38 +479,158 @@ func (a *adapter) open() {
 	// distinguish it from a slow server, so the timeout stays relevant.
 	dI.FailFast = true
 
+	if a.timeout > 0 {
+		dI.Timeout = a.timeout
+	}
+	return dI, nil
+}
+
+// openOrDefer opens the adapter with dI, or keeps dI for connect to open it
+// on first use when configured with WithLazyConnect.
+func (a *adapter) openOrDefer(dI *mgo.DialInfo) error {
+	if !a.lazyConnect {
+		return a.openWithDialInfo(dI)
+	}
+	info := *dI
+	a.lazyDialInfo = &info
+	return nil
+}
+
+// connect opens the adapter created with WithLazyConnect unless it is
+// already open. Failed attempts are retried by the next call. Every
+// operation reaching for the adapter's session or collection calls connect
+// first.
+func (a *adapter) connect() error {
+	if a.lazyDialInfo == nil {
+		return nil
+	}
+
+	a.connMu.Lock()
+	defer a.connMu.Unlock()
+	if a.session != nil {
+		return nil
+	}
+	// openWithDialInfo fills in the defaults of the dial info it is given.
+	info := *a.lazyDialInfo
+	return a.openWithDialInfo(&info)
+}
+
+// connected reports whether the adapter has a session.
+func (a *adapter) connected() bool {
+	if a.lazyDialInfo == nil {
+		return true
+	}
+
+	a.connMu.Lock()
+	defer a.connMu.Unlock()
+	return a.session != nil
+}
+
+func (a *adapter) openWithDialInfo(dI *mgo.DialInfo) error {
 	if dI.Database == "" {
-		dI.Database = "casbin"
+		dI.Database = defaultDatabaseName
+	}
+	a.pool.apply(dI)
+	if cred := a.credential; cred != nil {
+		dI.Username = cred.Username
+		dI.Password = cred.Password
+		dI.Source = cred.Source
+		dI.Mechanism = cred.Mechanism
+		dI.Service = cred.Service
+		dI.ServiceHost = cred.ServiceHost
 	}
 
 	session, err := mgo.DialWithInfo(dI)
 	if err != nil {
-		panic(err)
+		return classifyOpenError(err)
 	}
 
-	db := session.DB(dI.Database)
+	name := dI.Database
+	if a.databaseName != "" {
+		name = a.databaseName
+	}
+	db := session.DB(name)
 	a.session = session
-	a.openWithDB(db)
+	a.ownSession = true
+	a.applyConcerns(context.Background(), session)
+	if err := a.openWithDB(db); err != nil {
+		session.Close()
+		a.session = nil
+		a.ownSession = false
+		return err
+	}
+	return nil
 }
 
-func (a *adapter) close() {
-	a.session.Close()
+// Close stops the adapter's background activities, flushes the rules
+// buffered by write coalescing and, if the adapter opened its own session,
+// closes it. The session given to NewAdapterWithDB is left open for its
+// owner to close. Callers should defer Close after creating an adapter;
+// adapters which are not closed are eventually closed once garbage
+// collected, which may take a long time. The returned error gathers every
+// error encountered, each of which it matches with errors.Is.
+func (a *adapter) Close() error {
+	runtime.SetFinalizer(a, nil)
+	return a.close()
 }
 
-func (a *adapter) dropTable() error {
-	err := a.collection.DropCollection()
+// Ping checks that the server can be reached through the adapter's session,
+// e.g. for liveness and readiness probes, without querying the policy. It
+// honors ctx like LoadPolicyCtx. A failed ping refreshes the session, so the
+// next operation reconnects.
+func (a *adapter) Ping(ctx context.Context) error {
+	c, release, err := a.collectionFor(ctx)
 	if err != nil {
-		if err.Error() != "ns not found" {
-			return err
-		}
+		return err
+	}
+	defer release()
+
+	err = c.Database.Session.Ping()
+	if isConnectionError(err) {
+		a.session.Refresh()
+	}
+	return err
+}
+
+// Collection returns the collection holding the policy, e.g. to run ad-hoc
+// queries without keeping a separate handle that could drift from the
+// configured database and collection names. It is bound to the adapter's
+// session, which must not be closed; long-running work should go through a
+// copy of it, e.g. c.With(c.Database.Session.Copy()). It is nil while an
+// adapter created with WithLazyConnect cannot connect.
+func (a *adapter) Collection() *mgo.Collection {
+	if a.connect() != nil {
+		return nil
+	}
+	return a.collection
+}
+
+// close stops the adapter's background activities, flushes buffered writes
+// and closes its session if it owns it. It returns the errors encountered
+// along the way.
+func (a *adapter) close() error {
+	errs := a.shutdown()
+	if err := a.Flush(); err != nil {
+		errs = append(errs, err)
+	}
+	if a.ownSession && a.connected() {
+		a.session.Close()
+	}
+
+	if len(errs) > 0 {
+		return closeError(errs)
 	}
 	return nil
 }
 
-func loadPolicyLine(line CasbinRule, model model.Model) {
-	key := line.PType
-	sec := key[:1]
+func (a *adapter) dropTable() error {
+	if err := a.connect(); err != nil {
+		return err
+	}
+	return dropCollection(a.collection)
+}
 
+func policyTokens(line CasbinRule) []string {
 	tokens := []string{}
 	if line.V0 != "" {
 		tokens = append(tokens, line.V0)
@@ -164,19 +668,271 @@ func loadPolicyLine(line CasbinRule, model model.Model) {
 		goto LineEnd
 	}
 
+	tokens = append(tokens, line.VExtra...)
+
 LineEnd:
-	model[sec][key].Policy = append(model[sec][key].Policy, tokens)
+	return tokens
+}
+
+// loadPolicyLine appends a rule to the model and reports whether the model
+// defines its policy type. Rules of an unknown type, including those whose
+// whole section is missing from the model, are left out.
+func loadPolicyLine(key string, tokens []string, model model.Model) bool {
+	if key == "" {
+		return false
+	}
+	sec := key[:1]
+
+	ast, ok := model[sec][key]
+	if !ok || ast == nil {
+		return false
+	}
+
+	ast.Policy = append(ast.Policy, tokens)
+	return true
+}
+
+// checkArity returns an error identifying the document raw if the rule it
+// holds has more values than the model defines for its policy type.
+func checkArity(raw bson.Raw, ptype string, rule []string, model model.Model) error {
+	if ptype == "" {
+		return nil
+	}
+	ast, ok := model[ptype[:1]][ptype]
+	if !ok || ast == nil || len(rule) <= len(ast.Tokens) {
+		return nil
+	}
+
+	var doc struct {
+		ID interface{} `bson:"_id"`
+	}
+	raw.Unmarshal(&doc)
+	return fmt.Errorf("mongodbadapter: document %v holds a %q rule with %d values, but the model defines %d: %v", doc.ID, ptype, len(rule), len(ast.Tokens), rule)
+}
+
+// defaultLoadBatchSize is the number of rules loads fetch per round trip
+// unless configured with WithLoadBatchSize.
+const defaultLoadBatchSize = 1000
+
+// unknownPolicyTypesError lists the policy types that LoadPolicy found in the
+// database but could not find in the model.
+func unknownPolicyTypesError(ptypes map[string]struct{}) error {
+	names := make([]string, 0, len(ptypes))
+	for ptype := range ptypes {
+		names = append(names, ptype)
+	}
+	sort.Strings(names)
+
+	return &UnknownPolicyTypesError{PTypes: names}
 }
 
 // LoadPolicy loads policy from database.
 func (a *adapter) LoadPolicy(model model.Model) error {
-	line := CasbinRule{}
-	iter := a.collection.Find(nil).Iter()
-	for iter.Next(&line) {
-		loadPolicyLine(line, model)
+	return a.LoadPolicyCtx(context.Background(), model)
+}
+
+// LoadPolicyCtx is like LoadPolicy, honoring ctx as far as mgo allows: a done
+// ctx fails right away and a ctx deadline bounds every round trip.
+func (a *adapter) LoadPolicyCtx(ctx context.Context, model model.Model) error {
+	return a.runCtx(ctx, "LoadPolicy", func(c *mgo.Collection) error {
+		a.isFiltered = false
+		return a.loadPolicy(ctx, c, model, nil)
+	})
+}
+
+// loadPolicy loads the rules matching selector into the model. The rules are
+// read into an empty copy of the model first and only added to the model once
+// all of them have been read successfully, so that a failure midway, e.g. a
+// network error, leaves the model as it was.
+func (a *adapter) loadPolicy(ctx context.Context, c *mgo.Collection, model model.Model, selector interface{}) error {
+	loaded := emptyCopy(model)
+	if err := a.readPolicy(ctx, c, loaded, selector); err != nil {
+		return err
+	}
+
+	mergePolicy(model, loaded)
+	return nil
+}
+
+// LoadPolicyFromCollections loads the rules of the named collections of the
+// adapter's database into the model, e.g. those of several tenants for a
+// cross-tenant view. The collections must store their rules like the
+// adapter's own collection. Like with LoadPolicy, the model is left as it was
+// if reading any of them fails.
+func (a *adapter) LoadPolicyFromCollections(model model.Model, names ...string) error {
+	ctx := context.Background()
+	return a.runCtx(ctx, "LoadPolicyFromCollections", func(c *mgo.Collection) error {
+		loaded := emptyCopy(model)
+		for _, name := range names {
+			if err := a.readPolicy(ctx, c.Database.C(name), loaded, nil); err != nil {
+				return err
+			}
+		}
+
+		mergePolicy(model, loaded)
+		return nil
+	})
+}
+
+// mergePolicy appends the rules of loaded, an emptyCopy of model, to model.
+func mergePolicy(model, loaded model.Model) {
+	for sec, assertions := range loaded {
+		for key, ast := range assertions {
+			model[sec][key].Policy = append(model[sec][key].Policy, ast.Policy...)
+		}
+	}
+}
+
+// emptyCopy returns a model with the same definitions as m but no rules.
+func emptyCopy(m model.Model) model.Model {
+	c := make(model.Model, len(m))
+	for sec, assertions := range m {
+		c[sec] = make(model.AssertionMap, len(assertions))
+		for key, ast := range assertions {
+			if ast == nil {
+				continue
+			}
+			empty := *ast
+			empty.Policy = nil
+			c[sec][key] = &empty
+		}
+	}
+	return c
+}
+
+// readPolicy reads the rules of c matching selector into the model. c must be
+// bound to a session of its own, whose read preference is set as configured
+// with WithLoadReadPreference. The rules are fetched in batches, see
+// WithLoadBatchSize, and ctx is checked between them, so that a load is only
+// bounded as a whole by the deadline of ctx; the adapter's timeout only
+// bounds every batch.
+func (a *adapter) readPolicy(ctx context.Context, c *mgo.Collection, model model.Model, selector interface{}) error {
+	if a.loadMode != nil {
+		c.Database.Session.SetMode(*a.loadMode, true)
+	}
+
+	if a.requireCollection {
+		if err := checkCollectionExists(c); err != nil {
+			return err
+		}
+	}
+
+	unknown := make(map[string]struct{})
+
+	count := 0
+	var raw bson.Raw
+	query := a.find(c, selector).Select(a.loadProjection())
+	if len(a.loadSort) > 0 {
+		query = query.Sort(a.loadSort...)
+	}
+	batchSize := a.loadBatchSize
+	if batchSize <= 0 {
+		batchSize = defaultLoadBatchSize
+	}
+	iter := query.Batch(batchSize).Iter()
+	for iter.Next(&raw) {
+		count++
+		if a.maxLoadCount > 0 && count > a.maxLoadCount {
+			iter.Close()
+			return ErrTooManyRules
+		}
+		if count%batchSize == 0 {
+			if err := ctx.Err(); err != nil {
+				iter.Close()
+				return err
+			}
+		}
+
+		ptype, rule, err := a.decode(raw)
+		if err != nil {
+			iter.Close()
+			return err
+		}
+		if a.checksumKey != nil {
+			if err := a.verifyChecksum(raw, ptype, rule); err != nil {
+				if a.skipInvalidChecksums {
+					continue
+				}
+				iter.Close()
+				return err
+			}
+		}
+		if a.strictArity {
+			if err := checkArity(raw, ptype, rule, model); err != nil {
+				iter.Close()
+				return err
+			}
+		}
+		if !loadPolicyLine(ptype, rule, model) {
+			unknown[ptype] = struct{}{}
+		}
+	}
+	if err := iter.Close(); err != nil {
+		return err
 	}
 
-	return iter.Close()
+	if len(unknown) > 0 && !a.skipUnknownPTypes {
+		return unknownPolicyTypesError(unknown)
+	}
+	return nil
+}
+
+// loadProjection returns the fields LoadPolicy reads from each document, or
+// nil to read whole documents. Unless configured with WithLoadProjection, the
+// projection is only restricted for DefaultCodec alone, whose fields are
+// known.
+func (a *adapter) loadProjection() interface{} {
+	var projection bson.M
+	switch {
+	case a.projection != nil:
+		projection = bson.M{}
+		for k, v := range a.projection {
+			projection[k] = v
+		}
+	case a.codec == DefaultCodec && len(a.fallbackCodecs) == 0:
+		projection = bson.M{"ptype": 1, "v0": 1, "v1": 1, "v2": 1, "v3": 1, "v4": 1, "v5": 1, "vextra": 1}
+		if !a.strictArity {
+			projection["_id"] = 0
+		}
+	default:
+		return nil
+	}
+
+	if a.checksumKey != nil {
+		projection[checksumField] = 1
+	}
+	return projection
+}
+
+// checkCollectionExists returns ErrCollectionNotFound if c does not exist.
+func checkCollectionExists(c *mgo.Collection) error {
+	names, err := c.Database.CollectionNames()
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if name == c.Name {
+			return nil
+		}
+	}
+	return ErrCollectionNotFound
+}
+
+// SetMaxLoadCount limits the number of rules LoadPolicy is willing to read.
+// Once more than n rules have been read, LoadPolicy gives up and returns
+// ErrTooManyRules, which protects memory-constrained services from a
+// collection that grew unexpectedly. A non-positive n, the default, means no
+// limit.
+func (a *adapter) SetMaxLoadCount(n int) {
+	a.maxLoadCount = n
+}
+
+// newID returns the id of a document about to be inserted.
+func (a *adapter) newID() bson.ObjectId {
+	if a.idFactory != nil {
+		return a.idFactory()
+	}
+	return bson.NewObjectId()
 }
 
 func savePolicyLine(ptype string, rule []string) CasbinRule {
@@ -202,58 +958,207 @@ func savePolicyLine(ptype string, rule []string) CasbinRule {
 	if len(rule) > 5 {
 		line.V5 = rule[5]
 	}
+	if len(rule) > 6 {
+		line.VExtra = append([]string(nil), rule[6:]...)
+	}
 
 	return line
 }
 
-// SavePolicy saves policy to database.
+// SavePolicy saves policy to database, replacing the stored one. Unless the
+// adapter is configured with WithAtomicSave, the collection is dropped before
+// the rules are inserted, so a failure in between loses the stored policy;
+// mgo cannot run the two steps in a MongoDB transaction.
 func (a *adapter) SavePolicy(model model.Model) error {
-	if err := a.dropTable(); err != nil {
+	return a.SavePolicyCtx(context.Background(), model)
+}
+
+// SavePolicyCtx is like SavePolicy, honoring ctx like LoadPolicyCtx. Every
+// rule is encoded before anything is written, and ctx is checked again right
+// before the stored policy is dropped or, with WithAtomicSave, replaced, so
+// that a cancelled save leaves it intact. Without WithAtomicSave, a deadline
+// expiring while the rules are inserted still leaves them partially written.
+func (a *adapter) SavePolicyCtx(ctx context.Context, model model.Model) error {
+	err := a.runCtx(ctx, "SavePolicy", func(c *mgo.Collection) error {
+		return a.savePolicy(ctx, c, model)
+	})
+	return a.logChange(err, PolicyChange{Op: "SavePolicy"})
+}
+
+func (a *adapter) savePolicy(ctx context.Context, c *mgo.Collection, model model.Model) error {
+	if a.atomicSave {
+		return a.saveAtomically(ctx, c, model)
+	}
+
+	lines, err := a.savePolicyLines(model)
+	if err != nil {
+		return err
+	}
+
+	if err := ctx.Err(); err != nil {
 		return err
 	}
+	if err := a.resetCollection(c); err != nil {
+		return err
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+	return c.Insert(lines...)
+}
 
+// savePolicyLines encodes every rule of the model. Rules the model holds more
+// than once are only encoded once, so that saving never stores duplicates
+// and does not trip over the unique index.
+func (a *adapter) savePolicyLines(model model.Model) ([]interface{}, error) {
 	var lines []interface{}
+	seen := make(map[string]struct{})
 
-	for ptype, ast := range model["p"] {
-		for _, rule := range ast.Policy {
-			line := savePolicyLine(ptype, rule)
-			lines = append(lines, &line)
-		}
-	}
+	for _, sec := range []string{"p", "g"} {
+		for ptype, ast := range model[sec] {
+			if ast == nil {
+				continue
+			}
+			for _, rule := range ast.Policy {
+				key := ruleKey(ptype, rule)
+				if _, ok := seen[key]; ok {
+					continue
+				}
+				seen[key] = struct{}{}
 
-	for ptype, ast := range model["g"] {
-		for _, rule := range ast.Policy {
-			line := savePolicyLine(ptype, rule)
-			lines = append(lines, &line)
+				line, err := a.encode(sec, ptype, rule)
+				if err != nil {
+					return nil, err
+				}
+				lines = append(lines, line)
+			}
 		}
 	}
 
-	return a.collection.Insert(lines...)
+	return lines, nil
+}
+
+// ruleKey returns a string identifying a rule of the given policy type.
+func ruleKey(ptype string, rule []string) string {
+	return ptype + "\x00" + strings.Join(rule, "\x00")
 }
 
 // AddPolicy adds a policy rule to the storage.
 func (a *adapter) AddPolicy(sec string, ptype string, rule []string) error {
-	line := savePolicyLine(ptype, rule)
-	return a.collection.Insert(line)
+	return a.AddPolicyCtx(context.Background(), sec, ptype, rule)
+}
+
+// AddPolicyCtx is like AddPolicy, honoring ctx like LoadPolicyCtx. A rule
+// buffered by write coalescing is written later regardless of ctx.
+func (a *adapter) AddPolicyCtx(ctx context.Context, sec string, ptype string, rule []string) error {
+	err := a.runCtx(ctx, "AddPolicy", func(c *mgo.Collection) error {
+		return a.addPolicy(c, sec, ptype, rule)
+	})
+	return a.logChange(err, PolicyChange{Op: "AddPolicy", Sec: sec, PType: ptype, Rules: [][]string{rule}})
+}
+
+func (a *adapter) addPolicy(c *mgo.Collection, sec string, ptype string, rule []string) error {
+	line, err := a.encode(sec, ptype, rule)
+	if err != nil {
+		return err
+	}
+	if len(a.upsertKey) > 0 {
+		_, err := a.upsert(c, line)
+		return err
+	}
+	if a.addBuffer != nil {
+		return a.bufferAdd(line)
+	}
+	_, err = a.insert(c, line)
+	return err
+}
+
+// insert inserts docs into c and returns the number of documents inserted,
+// which is only meaningful without error. With WithIgnoreDuplicates, the
+// documents are inserted in a single unordered request, so that those
+// already stored do not prevent the others from being inserted, and
+// duplicate key errors are ignored.
+func (a *adapter) insert(c *mgo.Collection, docs ...interface{}) (int64, error) {
+	if !a.ignoreDuplicates {
+		if err := c.Insert(docs...); err != nil {
+			return 0, err
+		}
+		return int64(len(docs)), nil
+	}
+
+	bulk := c.Bulk()
+	bulk.Unordered()
+	bulk.Insert(docs...)
+	_, err := bulk.Run()
+	if err != nil && !mgo.IsDup(err) {
+		return 0, err
+	}
+	n := int64(len(docs))
+	if berr, ok := err.(*mgo.BulkError); ok {
+		n -= int64(len(berr.Cases()))
+	}
+	return n, nil
 }
 
 // RemovePolicy removes a policy rule from the storage.
 func (a *adapter) RemovePolicy(sec string, ptype string, rule []string) error {
-	line := savePolicyLine(ptype, rule)
-	if err := a.collection.Remove(line); err != nil {
+	return a.RemovePolicyCtx(context.Background(), sec, ptype, rule)
+}
+
+// RemovePolicyCtx is like RemovePolicy, honoring ctx like LoadPolicyCtx.
+func (a *adapter) RemovePolicyCtx(ctx context.Context, sec string, ptype string, rule []string) error {
+	err := a.runCtx(ctx, "RemovePolicy", func(c *mgo.Collection) error {
+		_, err := a.removePolicy(c, sec, ptype, rule)
+		return err
+	})
+	return a.logChange(err, PolicyChange{Op: "RemovePolicy", Sec: sec, PType: ptype, Rules: [][]string{rule}})
+}
+
+// removePolicy removes one stored copy of rule and returns the number of
+// rules removed, 0 if it is not stored.
+func (a *adapter) removePolicy(c *mgo.Collection, sec string, ptype string, rule []string) (int64, error) {
+	line, err := a.selector(sec, ptype, rule)
+	if err != nil {
+		return 0, err
+	}
+	if a.archive != nil {
+		ids, err := a.archiveMatching(c, line, 1)
+		if err != nil || len(ids) == 0 {
+			return 0, err
+		}
+		if err := c.RemoveId(ids[0]); err != nil {
+			return 0, err
+		}
+		return 1, nil
+	}
+	if a.collation != nil {
+		ids, err := a.matchingIDs(c, line, 1)
+		if err != nil || len(ids) == 0 {
+			return 0, err
+		}
+		if err := c.RemoveId(ids[0]); err != nil {
+			return 0, err
+		}
+		return 1, nil
+	}
+
+	if err := c.Remove(line); err != nil {
 		switch err {
 		case mgo.ErrNotFound:
-			return nil
+			return 0, nil
 		default:
-			return err
+			return 0, err
 		}
 	}
-	return nil
+	return 1, nil
 }
 
-// RemoveFilteredPolicy removes policy rules that match the filter from the storage.
-func (a *adapter) RemoveFilteredPolicy(sec string, ptype string, fieldIndex int, fieldValues ...string) error {
-	selector := make(map[string]interface{})
+// BuildFilterSelector returns the selector matching the rules of the given
+// policy type whose values, starting at fieldIndex, equal fieldValues, as
+// used by RemoveFilteredPolicy. Values beyond v5 are matched against the
+// elements of vextra. Values at negative positions are ignored.
+func BuildFilterSelector(ptype string, fieldIndex int, fieldValues ...string) bson.M {
+	selector := bson.M{}
 	selector["ptype"] = ptype
 
 	if fieldIndex <= 0 && 0 < fieldIndex+len(fieldValues) {
@@ -274,7 +1179,196 @@ func (a *adapter) RemoveFilteredPolicy(sec string, ptype string, fieldIndex int,
 	if fieldIndex <= 5 && 5 < fieldIndex+len(fieldValues) {
 		selector["v5"] = fieldValues[5-fieldIndex]
 	}
+	for i := 6; i < fieldIndex+len(fieldValues); i++ {
+		if fieldIndex <= i {
+			selector["vextra."+strconv.Itoa(i-6)] = fieldValues[i-fieldIndex]
+		}
+	}
 
-	_, err := a.collection.RemoveAll(selector)
+	return selector
+}
+
+// BuildFieldsSelector returns the selector matching the rules of the given
+// policy type whose values at the positions of fields equal the mapped
+// values, the other values being unconstrained, as used by
+// RemoveFilteredPolicyByFields. Like with BuildFilterSelector, positions
+// beyond 5 are matched against the elements of vextra and negative positions
+// are ignored.
+func BuildFieldsSelector(ptype string, fields map[int]string) bson.M {
+	selector := bson.M{"ptype": ptype}
+	for i, value := range fields {
+		switch {
+		case i < 0:
+		case i < 6:
+			selector["v"+strconv.Itoa(i)] = value
+		default:
+			selector["vextra."+strconv.Itoa(i-6)] = value
+		}
+	}
+	return selector
+}
+
+// RemoveFilteredPolicy removes policy rules that match the filter from the storage.
+// sec is not part of the selector: Casbin names every policy type after its
+// section ("p", "p2", "g", "g2", ...), so ptype alone tells the sections apart,
+// like it does when the policy is saved and loaded.
+func (a *adapter) RemoveFilteredPolicy(sec string, ptype string, fieldIndex int, fieldValues ...string) error {
+	return a.RemoveFilteredPolicyCtx(context.Background(), sec, ptype, fieldIndex, fieldValues...)
+}
+
+// RemoveFilteredPolicyCtx is like RemoveFilteredPolicy, honoring ctx like
+// LoadPolicyCtx.
+func (a *adapter) RemoveFilteredPolicyCtx(ctx context.Context, sec string, ptype string, fieldIndex int, fieldValues ...string) error {
+	_, err := a.RemoveFilteredPolicyCount(ctx, sec, ptype, fieldIndex, fieldValues...)
 	return err
 }
+
+// RemoveFilteredPolicyCount is like RemoveFilteredPolicyCtx and returns the
+// number of rules removed, telling whether the filter matched anything.
+func (a *adapter) RemoveFilteredPolicyCount(ctx context.Context, sec string, ptype string, fieldIndex int, fieldValues ...string) (int64, error) {
+	var n int64
+	err := a.runCtx(ctx, "RemoveFilteredPolicy", func(c *mgo.Collection) error {
+		var err error
+		n, err = a.removeFilteredPolicy(c, sec, ptype, fieldIndex, fieldValues...)
+		return err
+	})
+	return n, a.logChange(err, PolicyChange{Op: "RemoveFilteredPolicy", Sec: sec, PType: ptype, FieldIndex: fieldIndex, FieldValues: fieldValues})
+}
+
+func (a *adapter) removeFilteredPolicy(c *mgo.Collection, sec string, ptype string, fieldIndex int, fieldValues ...string) (int64, error) {
+	return a.removeMatching(c, BuildFilterSelector(ptype, fieldIndex, fieldValues...))
+}
+
+// RemoveFilteredPolicyByFields removes the rules of the given policy type
+// whose values at the positions of fields equal the mapped values, whatever
+// their other values, e.g. map[int]string{2: "read"} to revoke an action from
+// every subject and object.
+func (a *adapter) RemoveFilteredPolicyByFields(ptype string, fields map[int]string) error {
+	err := a.runCtx(context.Background(), "RemoveFilteredPolicyByFields", func(c *mgo.Collection) error {
+		_, err := a.removeMatching(c, BuildFieldsSelector(ptype, fields))
+		return err
+	})
+	return a.logChange(err, PolicyChange{Op: "RemoveFilteredPolicyByFields", PType: ptype, Fields: fields})
+}
+
+// removeMatching removes, and archives if configured, the rules matched by
+// selector and returns the number of rules removed.
+func (a *adapter) removeMatching(c *mgo.Collection, selector bson.M) (int64, error) {
+	selector = a.renameFields(selector)
+	if a.archive != nil {
+		ids, err := a.archiveMatching(c, selector, 0)
+		if err != nil || len(ids) == 0 {
+			return 0, err
+		}
+		selector = bson.M{"_id": bson.M{"$in": ids}}
+	} else if a.collation != nil {
+		ids, err := a.matchingIDs(c, selector, 0)
+		if err != nil || len(ids) == 0 {
+			return 0, err
+		}
+		selector = bson.M{"_id": bson.M{"$in": ids}}
+	}
+
+	info, err := c.RemoveAll(selector)
+	if err != nil {
+		return 0, err
+	}
+	return int64(info.Removed), nil
+}
+
+// ClearPolicy removes every rule from the storage, e.g. to reset a test
+// database, without going through SavePolicy with an empty model. The
+// collection is kept along with its indexes and options, and a missing
+// collection is not an error. Rules are not archived.
+func (a *adapter) ClearPolicy(ctx context.Context) error {
+	err := a.runCtx(ctx, "ClearPolicy", func(c *mgo.Collection) error {
+		_, err := c.RemoveAll(nil)
+		return err
+	})
+	return a.logChange(err, PolicyChange{Op: "ClearPolicy"})
+}
+
+// GetPoliciesForSubjects returns the rules of the given ptype whose subject
+// (v0) is one of subjects, grouped by subject. All subjects are resolved with
+// a single query.
+func (a *adapter) GetPoliciesForSubjects(ptype string, subjects []string) (map[string][][]string, error) {
+	res := make(map[string][][]string)
+	if len(subjects) == 0 {
+		return res, nil
+	}
+
+	selector := a.renameFields(bson.M{
+		"ptype": ptype,
+		"v0":    bson.M{"$in": subjects},
+	})
+
+	err := a.runCtx(context.Background(), "GetPoliciesForSubjects", func(c *mgo.Collection) error {
+		res = make(map[string][][]string)
+		var raw bson.Raw
+		iter := a.find(c, selector).Iter()
+		for iter.Next(&raw) {
+			_, rule, err := a.decode(raw)
+			if err != nil {
+				iter.Close()
+				return err
+			}
+			if len(rule) > 0 {
+				res[rule[0]] = append(res[rule[0]], rule)
+			}
+		}
+		return iter.Close()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// PolicyCount returns the number of documents storing exactly the given rule.
+// A count above 1 means the rule is stored more than once, in which case a
+// single RemovePolicy does not revoke it.
+func (a *adapter) PolicyCount(ptype string, rule []string) (int64, error) {
+	sec := ""
+	if ptype != "" {
+		sec = ptype[:1]
+	}
+
+	selector, err := a.selector(sec, ptype, rule)
+	if err != nil {
+		return 0, err
+	}
+
+	var n int
+	err = a.runCtx(context.Background(), "PolicyCount", func(c *mgo.Collection) error {
+		var err error
+		n, err = a.find(c, selector).Count()
+		return err
+	})
+	return int64(n), err
+}
+
+// TagFiltered sets the fields in set, e.g. bson.M{"reviewedAt": time.Now()},
+// on every rule matched by the same arguments as RemoveFilteredPolicy, and
+// returns the number of rules matched. It is meant for annotations: setting
+// the "ptype" or "v0" to "v5" fields changes the rules themselves behind the
+// back of any loaded model and of their checksum.
+func (a *adapter) TagFiltered(sec string, ptype string, fieldIndex int, fieldValues []string, set bson.M) (int64, error) {
+	var n int64
+	err := a.runCtx(context.Background(), "TagFiltered", func(c *mgo.Collection) error {
+		var selector interface{} = a.renameFields(BuildFilterSelector(ptype, fieldIndex, fieldValues...))
+		if a.collation != nil {
+			ids, err := a.matchingIDs(c, selector, 0)
+			if err != nil {
+				return err
+			}
+			selector = bson.M{"_id": bson.M{"$in": ids}}
+		}
+		info, err := c.UpdateAll(selector, bson.M{"$set": set})
+		if err != nil {
+			return err
+		}
+		n = int64(info.Matched)
+		return nil
+	})
+	return n, err
+}
@@ -15,11 +15,24 @@
 package mongodbadapter
 
 import (
+	"context"
+	"errors"
+	"io"
+	"net"
 	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/casbin/casbin"
 	"github.com/casbin/casbin/util"
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+	"github.com/globalsign/mgo/txn"
 )
 
 var testDbURL = os.Getenv("TEST_MONGODB_URL")
@@ -156,3 +169,2767 @@ func TestNewAdapterWithUnknownURL(t *testing.T) {
 
 	_ = NewAdapter("fakeserver:27017")
 }
+
+func TestMaxStalenessUnsupported(t *testing.T) {
+	url := getDbURL() + "/casbin?readPreference=secondaryPreferred&maxStalenessSeconds=120"
+	if _, err := NewAdapterWithError(url); err != ErrMaxStalenessUnsupported {
+		t.Errorf("got error %v for %s, want %v", err, url, ErrMaxStalenessUnsupported)
+	}
+}
+
+func TestLazyConnect(t *testing.T) {
+	a, err := NewAdapterWithError("fakeserver:27017", WithLazyConnect(), WithTimeout(time.Second))
+	if err != nil {
+		t.Fatalf("Expected NewAdapterWithError() not to connect; got %v", err)
+	}
+	e := casbin.NewEnforcer("examples/rbac_model.conf", "examples/rbac_policy.csv")
+	if err := a.LoadPolicy(e.GetModel()); !errors.Is(err, ErrUnreachable) && !errors.Is(err, ErrTimeout) {
+		t.Errorf("Expected LoadPolicy() to fail with ErrUnreachable or ErrTimeout; got %v", err)
+	}
+	if err := a.(*adapter).Close(); err != nil {
+		t.Errorf("Expected closing an unconnected adapter to be successful; got %v", err)
+	}
+
+	initPolicy(t)
+	a, err = NewAdapterWithError(getDbURL(), WithLazyConnect())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.(*adapter).connected() {
+		t.Error("Expected the adapter not to be connected before its first operation")
+	}
+	e = casbin.NewEnforcer("examples/rbac_model.conf", a)
+	testGetPolicy(t, e, [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}})
+}
+
+func TestPingOnOpen(t *testing.T) {
+	// A dialer which stops connecting once the session is established
+	// simulates a shared connection which died since.
+	var dead int32
+	info, err := mgo.ParseURL(getDbURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	info.FailFast = true
+	info.Timeout = time.Second
+	info.DialServer = func(addr *mgo.ServerAddr) (net.Conn, error) {
+		if atomic.LoadInt32(&dead) == 1 {
+			return nil, errors.New("connection refused")
+		}
+		return net.DialTimeout("tcp", addr.String(), time.Second)
+	}
+	session, err := mgo.DialWithInfo(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+
+	_ = NewAdapterWithDB(session.DB("casbin"), WithPing())
+
+	atomic.StoreInt32(&dead, 1)
+	session.Refresh()
+	defer func() {
+		if r := recover(); r == nil {
+			t.Error("Expected pinging a dead connection to panic")
+		}
+	}()
+	_ = NewAdapterWithDB(session.DB("casbin"), WithPing())
+}
+
+func TestGetPoliciesForSubjects(t *testing.T) {
+	initPolicy(t)
+
+	a := NewAdapter(getDbURL()).(*adapter)
+	res, err := a.GetPoliciesForSubjects("p", []string{"alice", "data2_admin", "nobody"})
+	if err != nil {
+		t.Fatalf("Expected GetPoliciesForSubjects() to be successful; got %v", err)
+	}
+
+	if !util.Array2DEquals(res["alice"], [][]string{{"alice", "data1", "read"}}) {
+		t.Error("Policies for alice: ", res["alice"])
+	}
+	if !util.Array2DEquals(res["data2_admin"], [][]string{{"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}}) {
+		t.Error("Policies for data2_admin: ", res["data2_admin"])
+	}
+	if _, ok := res["nobody"]; ok {
+		t.Error("Expected no policies for nobody; got ", res["nobody"])
+	}
+}
+
+func TestIndexUsageStats(t *testing.T) {
+	initPolicy(t)
+
+	a := NewAdapter(getDbURL()).(*adapter)
+	if _, err := a.GetPoliciesForSubjects("p", []string{"alice"}); err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := a.IndexUsageStats(context.Background())
+	if err != nil {
+		t.Fatalf("Expected IndexUsageStats() to be successful; got %v", err)
+	}
+	for _, stat := range stats {
+		if stat["name"] == "_id_" {
+			continue
+		}
+		accesses, _ := stat["accesses"].(bson.M)
+		if ops, _ := accesses["ops"].(int64); ops > 0 {
+			return
+		}
+	}
+	t.Errorf("Expected the query to be counted in the stats of a rule index; got %v", stats)
+}
+
+func TestAggregate(t *testing.T) {
+	initPolicy(t)
+
+	a := NewAdapter(getDbURL()).(*adapter)
+	iter, err := a.Aggregate(context.Background(), []bson.M{
+		{"$group": bson.M{"_id": "$ptype", "count": bson.M{"$sum": 1}}},
+	})
+	if err != nil {
+		t.Fatalf("Expected Aggregate() to be successful; got %v", err)
+	}
+	counts := make(map[string]int)
+	var result struct {
+		PType string `bson:"_id"`
+		Count int    `bson:"count"`
+	}
+	for iter.Next(&result) {
+		counts[result.PType] = result.Count
+	}
+	if err := iter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(counts, map[string]int{"p": 4, "g": 1}) {
+		t.Errorf("got counts %v, want 4 p and 1 g rules", counts)
+	}
+}
+
+func TestArchiveCollection(t *testing.T) {
+	initPolicy(t)
+
+	a := NewAdapter(getDbURL(), WithArchiveCollection("casbin_rule_archive")).(*adapter)
+	if _, err := a.archive.RemoveAll(nil); err != nil {
+		t.Fatalf("Expected clearing the archive to be successful; got %v", err)
+	}
+
+	if err := a.RemovePolicy("p", "p", []string{"alice", "data1", "read"}); err != nil {
+		t.Errorf("Expected RemovePolicy() to be successful; got %v", err)
+	}
+	if err := a.RemoveFilteredPolicy("p", "p", 0, "data2_admin"); err != nil {
+		t.Errorf("Expected RemoveFilteredPolicy() to be successful; got %v", err)
+	}
+
+	var archived []CasbinRule
+	if err := a.archive.Find(nil).All(&archived); err != nil {
+		t.Fatalf("Expected reading the archive to be successful; got %v", err)
+	}
+	if len(archived) != 3 {
+		t.Errorf("Expected 3 archived rules; got %v", archived)
+	}
+
+	e := casbin.NewEnforcer("examples/rbac_model.conf", a)
+	testGetPolicy(t, e, [][]string{{"bob", "data2", "write"}})
+}
+
+func TestLoadPolicyWithUnknownPolicyType(t *testing.T) {
+	initPolicy(t)
+
+	a := NewAdapter(getDbURL()).(*adapter)
+	if err := a.collection.Insert(CasbinRule{PType: "g3", V0: "alice", V1: "stale"}); err != nil {
+		t.Fatalf("Expected inserting a stale rule to be successful; got %v", err)
+	}
+
+	e := casbin.NewEnforcer("examples/rbac_model.conf", "examples/rbac_policy.csv")
+	e.ClearPolicy()
+	if err := a.LoadPolicy(e.GetModel()); err == nil {
+		t.Error("Expected LoadPolicy() to fail on an unknown policy type")
+	}
+
+	a = NewAdapter(getDbURL(), WithSkipUnknownPolicyTypes()).(*adapter)
+	e.ClearPolicy()
+	if err := a.LoadPolicy(e.GetModel()); err != nil {
+		t.Errorf("Expected LoadPolicy() to be successful; got %v", err)
+	}
+	testGetPolicy(t, e, [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}})
+}
+
+func TestLoadPolicyReportsEveryUnknownPolicyType(t *testing.T) {
+	initPolicy(t)
+
+	a := NewAdapter(getDbURL()).(*adapter)
+	stale := []interface{}{
+		CasbinRule{PType: "p9", V0: "alice", V1: "data1", V2: "read"},
+		CasbinRule{PType: "g3", V0: "alice", V1: "stale"},
+		CasbinRule{PType: "g3", V0: "bob", V1: "stale"},
+	}
+	if err := a.collection.Insert(stale...); err != nil {
+		t.Fatal(err)
+	}
+
+	e := casbin.NewEnforcer("examples/rbac_model.conf", "examples/rbac_policy.csv")
+	e.ClearPolicy()
+	err := a.LoadPolicy(e.GetModel())
+	if err == nil || err.Error() != `mongodbadapter: policy types not defined in the model: "g3", "p9"` {
+		t.Errorf("Expected LoadPolicy() to report g3 and p9; got %v", err)
+	}
+}
+
+func TestCopyTo(t *testing.T) {
+	initPolicy(t)
+
+	src := NewAdapter(getDbURL()).(*adapter)
+	dst := NewAdapter(getDbURL() + "/casbin_copy").(*adapter)
+	if err := dst.dropTable(); err != nil {
+		t.Fatalf("Expected dropping the destination to be successful; got %v", err)
+	}
+
+	err := src.CopyTo(dst, func(line CasbinRule) (CasbinRule, error) {
+		if line.V0 == "bob" {
+			line.V0 = "robert"
+		}
+		return line, nil
+	})
+	if err != nil {
+		t.Fatalf("Expected CopyTo() to be successful; got %v", err)
+	}
+
+	e := casbin.NewEnforcer("examples/rbac_model.conf", dst)
+	testGetPolicy(t, e, [][]string{{"alice", "data1", "read"}, {"robert", "data2", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}})
+}
+
+func TestUniqueIndex(t *testing.T) {
+	initPolicy(t)
+
+	a := NewAdapter(getDbURL(), WithUniqueIndex())
+	if err := a.AddPolicy("p", "p", []string{"alice", "data1", "read"}); !mgo.IsDup(err) {
+		t.Errorf("Expected a duplicate key error; got %v", err)
+	}
+	if err := a.AddPolicy("p", "p", []string{"alice", "data1"}); err != nil {
+		t.Errorf("Expected AddPolicy() of a shorter rule to be successful; got %v", err)
+	}
+}
+
+func TestReadWriteAdapter(t *testing.T) {
+	initPolicy(t)
+
+	a := NewReadWriteAdapter(NewAdapter(getDbURL()), NewAdapter(getDbURL()))
+	e := casbin.NewEnforcer("examples/rbac_model.conf", a)
+	testGetPolicy(t, e, [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}})
+
+	e.AddPolicy("alice", "data1", "write")
+	if err := e.LoadPolicy(); err != nil {
+		t.Errorf("Expected LoadPolicy() to be successful; got %v", err)
+	}
+	testGetPolicy(t, e, [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}, {"alice", "data1", "write"}})
+}
+
+func TestMaxLoadCount(t *testing.T) {
+	initPolicy(t)
+
+	a := NewAdapter(getDbURL()).(*adapter)
+	e := casbin.NewEnforcer("examples/rbac_model.conf", "examples/rbac_policy.csv")
+
+	a.SetMaxLoadCount(3)
+	e.ClearPolicy()
+	if err := a.LoadPolicy(e.GetModel()); err != ErrTooManyRules {
+		t.Errorf("Expected LoadPolicy() to return ErrTooManyRules; got %v", err)
+	}
+
+	a.SetMaxLoadCount(5)
+	e.ClearPolicy()
+	if err := a.LoadPolicy(e.GetModel()); err != nil {
+		t.Errorf("Expected LoadPolicy() to be successful; got %v", err)
+	}
+}
+
+func TestIDFactory(t *testing.T) {
+	initPolicy(t)
+
+	id := bson.ObjectIdHex("5a8f3e2b9d1c4a0001000001")
+	a := NewAdapter(getDbURL(), WithIDFactory(func() bson.ObjectId { return id })).(*adapter)
+	if err := a.AddPolicy("p", "p", []string{"carol", "data3", "read"}); err != nil {
+		t.Fatalf("Expected AddPolicy() to be successful; got %v", err)
+	}
+
+	var line CasbinRule
+	if err := a.collection.FindId(id).One(&line); err != nil {
+		t.Fatalf("Expected the rule to be stored under the generated id; got %v", err)
+	}
+	if line.V0 != "carol" {
+		t.Errorf("Expected the rule for carol; got %v", line)
+	}
+}
+
+func TestLoadFilteredPolicy(t *testing.T) {
+	initPolicy(t)
+
+	a := NewAdapter(getDbURL()).(*adapter)
+	e := casbin.NewEnforcer("examples/rbac_model.conf", a)
+
+	if err := e.LoadFilteredPolicy(Filter{PType: []string{"p"}, V1: []string{"data2"}, Not: FilterNot{V0: []string{"bob"}}}); err != nil {
+		t.Fatalf("Expected LoadFilteredPolicy() to be successful; got %v", err)
+	}
+	testGetPolicy(t, e, [][]string{{"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}})
+	if !e.IsFiltered() {
+		t.Error("Expected the loaded policy to be filtered")
+	}
+
+	if err := e.LoadFilteredPolicy(&Filter{Not: FilterNot{V0: []string{"alice", "data2_admin"}}}); err != nil {
+		t.Fatalf("Expected LoadFilteredPolicy() to be successful; got %v", err)
+	}
+	testGetPolicy(t, e, [][]string{{"bob", "data2", "write"}})
+
+	if err := e.LoadFilteredPolicy(bson.M{"ptype": "p", "v2": "read"}); err != nil {
+		t.Fatalf("Expected LoadFilteredPolicy() to be successful; got %v", err)
+	}
+	testGetPolicy(t, e, [][]string{{"alice", "data1", "read"}, {"data2_admin", "data2", "read"}})
+
+	if err := e.LoadPolicy(); err != nil {
+		t.Fatalf("Expected LoadPolicy() to be successful; got %v", err)
+	}
+	if e.IsFiltered() {
+		t.Error("Expected the loaded policy not to be filtered")
+	}
+}
+
+func TestLoadFilteredPolicyWithQuery(t *testing.T) {
+	initPolicy(t)
+
+	a := NewAdapter(getDbURL()).(*adapter)
+	e := casbin.NewEnforcer("examples/rbac_model.conf", a)
+
+	if err := e.LoadFilteredPolicy(bson.D{{Name: "ptype", Value: "p"}, {Name: "v0", Value: bson.M{"$in": []string{"alice", "bob"}}}}); err != nil {
+		t.Fatalf("Expected LoadFilteredPolicy() to be successful; got %v", err)
+	}
+	testGetPolicy(t, e, [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}})
+	if !e.IsFiltered() {
+		t.Error("Expected the loaded policy to be filtered")
+	}
+
+	if err := e.LoadFilteredPolicy((*Filter)(nil)); err != nil {
+		t.Fatalf("Expected LoadFilteredPolicy() to be successful; got %v", err)
+	}
+	testGetPolicy(t, e, [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}})
+	if e.IsFiltered() {
+		t.Error("Expected a nil *Filter to load the whole policy")
+	}
+
+	if err := e.LoadFilteredPolicy(`{"ptype": "p"}`); err == nil {
+		t.Error("Expected LoadFilteredPolicy() to reject a query given as a string")
+	}
+}
+
+// arrayCodec stores rules as a single array field.
+type arrayCodec struct{}
+
+func (arrayCodec) Encode(sec string, ptype string, rule []string) (interface{}, error) {
+	return bson.M{"ptype": ptype, "rule": rule}, nil
+}
+
+func (arrayCodec) Decode(raw bson.Raw) (string, []string, error) {
+	var doc struct {
+		PType string
+		Rule  []string
+	}
+	err := raw.Unmarshal(&doc)
+	return doc.PType, doc.Rule, err
+}
+
+func TestCollectionInfo(t *testing.T) {
+	session, err := mgo.Dial(getDbURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	db := session.DB("casbin_validated")
+	if err := db.DropDatabase(); err != nil {
+		t.Fatal(err)
+	}
+	defer db.DropDatabase()
+
+	info := &mgo.CollectionInfo{Validator: bson.M{"ptype": bson.M{"$type": "string"}}}
+	for i := 0; i < 2; i++ {
+		// The second adapter finds the collection already created.
+		_ = NewAdapterWithDB(db, WithCollectionInfo(info))
+	}
+
+	c := db.C("casbin_rule")
+	if err := c.Insert(bson.M{"v0": "alice"}); err == nil {
+		t.Error("Expected the validator to reject a document without a policy type")
+	}
+	if err := c.Insert(CasbinRule{PType: "p", V0: "alice"}); err != nil {
+		t.Errorf("Expected the validator to accept a rule; got %v", err)
+	}
+}
+
+func TestPolicyTxOps(t *testing.T) {
+	a := NewAdapter(getDbURL(), WithCollectionName("casbin_rule_txn"), WithCaseInsensitive()).(*adapter)
+	defer a.dropTable()
+	if err := a.ClearPolicy(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	txns := a.collection.Database.C("casbin_txn")
+	defer txns.DropCollection()
+	runner := txn.NewRunner(txns)
+
+	op, err := a.AddPolicyTxOp("p", "p", []string{"carol", "data1", "read"})
+	if err != nil {
+		t.Fatalf("Expected AddPolicyTxOp() to be successful; got %v", err)
+	}
+	if err := runner.Run([]txn.Op{op}, "", nil); err != nil {
+		t.Fatalf("Expected the transaction to be successful; got %v", err)
+	}
+	if n, err := a.PolicyCount("p", []string{"carol", "data1", "read"}); err != nil || n != 1 {
+		t.Errorf("Expected the transaction to add the rule; got %d, %v", n, err)
+	}
+
+	ops, err := a.RemovePolicyTxOps("p", "p", []string{"CAROL", "data1", "read"})
+	if err != nil || len(ops) != 1 {
+		t.Fatalf("Expected RemovePolicyTxOps() to match the rule regardless of case; got %v, %v", ops, err)
+	}
+	if err := runner.Run(ops, "", nil); err != nil {
+		t.Fatalf("Expected the transaction to be successful; got %v", err)
+	}
+	if n, err := a.PolicyCount("p", []string{"carol", "data1", "read"}); err != nil || n != 0 {
+		t.Errorf("Expected the transaction to remove the rule; got %d, %v", n, err)
+	}
+
+	a = NewAdapter(getDbURL(), WithIgnoreDuplicates()).(*adapter)
+	if _, err := a.AddPolicyTxOp("p", "p", []string{"carol", "data1", "read", "a", "b", "c", "d"}); err == nil {
+		t.Error("Expected AddPolicyTxOp() to reject a rule WithIgnoreDuplicates cannot tell apart")
+	}
+}
+
+// recordingCodec is DefaultCodec recording the fields of the documents it
+// decodes.
+type recordingCodec struct {
+	fieldCodec
+	fields map[string]bool
+}
+
+func (c *recordingCodec) Decode(raw bson.Raw) (string, []string, error) {
+	var doc bson.M
+	if err := raw.Unmarshal(&doc); err != nil {
+		return "", nil, err
+	}
+	for name := range doc {
+		c.fields[name] = true
+	}
+	return c.fieldCodec.Decode(raw)
+}
+
+func TestLoadProjection(t *testing.T) {
+	initPolicy(t)
+
+	a := NewAdapter(getDbURL()).(*adapter)
+	if projection, ok := a.loadProjection().(bson.M); !ok || projection["ptype"] != 1 || projection["note"] != nil {
+		t.Errorf("Expected DefaultCodec to only load the rule fields; got projection %v", a.loadProjection())
+	}
+	if projection := NewAdapter(getDbURL(), WithCodec(arrayCodec{})).(*adapter).loadProjection(); projection != nil {
+		t.Errorf("Expected other codecs to load whole documents; got projection %v", projection)
+	}
+	if err := a.collection.Update(bson.M{"v0": "alice"}, bson.M{"$set": bson.M{"note": "metadata"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	codec := &recordingCodec{fields: make(map[string]bool)}
+	a = NewAdapter(getDbURL(), WithCodec(codec), WithLoadProjection(bson.M{"ptype": 1, "v0": 1, "v1": 1, "v2": 1})).(*adapter)
+	e := casbin.NewEnforcer("examples/rbac_model.conf", a)
+	testGetPolicy(t, e, [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}})
+	if codec.fields["note"] || codec.fields["v3"] {
+		t.Errorf("Expected the loaded documents to be projected; got fields %v", codec.fields)
+	}
+}
+
+func TestNewAdapterWithDialInfo(t *testing.T) {
+	initPolicy(t)
+
+	info, err := mgo.ParseURL(getDbURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := NewAdapterWithDialInfo(info).(*adapter)
+	if a.collection.FullName != "casbin.casbin_rule" {
+		t.Errorf("Expected an empty Database to store the rules in casbin.casbin_rule; got %s", a.collection.FullName)
+	}
+	e := casbin.NewEnforcer("examples/rbac_model.conf", a)
+	testGetPolicy(t, e, [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}})
+
+	info.Addrs = []string{"127.0.0.1:1"}
+	info.FailFast = true
+	info.Timeout = time.Second
+	defer func() {
+		if r := recover(); r == nil {
+			t.Error("Expected NewAdapterWithDialInfo() to panic for an unreachable server")
+		}
+	}()
+	_ = NewAdapterWithDialInfo(info)
+}
+
+func TestCheckIndexes(t *testing.T) {
+	session, err := mgo.Dial(getDbURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	db := session.DB("casbin_indexes")
+	if err := db.DropDatabase(); err != nil {
+		t.Fatal(err)
+	}
+	defer db.DropDatabase()
+
+	a := NewAdapterWithDB(db).(*adapter)
+	if problems, err := a.CheckIndexes(context.Background()); err != nil || len(problems) != 0 {
+		t.Fatalf("Expected CheckIndexes() to find the indexes as created; got %v, %v", problems, err)
+	}
+
+	dropped := a.expectedIndexes()[0]
+	if err := a.collection.DropIndex(dropped.Key...); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.collection.EnsureIndex(mgo.Index{Key: []string{"v1", "v2"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	problems, err := a.CheckIndexes(context.Background())
+	if err != nil {
+		t.Fatalf("Expected CheckIndexes() to be successful; got %v", err)
+	}
+	expected := []string{
+		"missing index on (" + indexKey(dropped) + ")",
+		"unexpected index v1_1_v2_1 on (v1,v2)",
+	}
+	if !reflect.DeepEqual(problems, expected) {
+		t.Errorf("got index problems %v, want %v", problems, expected)
+	}
+}
+
+func TestIndexBuildsInBackgroundBeforeMongo42(t *testing.T) {
+	session, err := mgo.Dial(getDbURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	info, err := session.BuildInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := session.DB("casbin_background")
+	defer db.DropDatabase()
+
+	for _, foreground := range []bool{false, true} {
+		if err := db.DropDatabase(); err != nil {
+			t.Fatal(err)
+		}
+		a := NewAdapterWithDB(db, WithIndexOptions(IndexOptions{Foreground: foreground})).(*adapter)
+		indexes, err := a.collection.Indexes()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expected := !foreground && !info.VersionAtLeast(4, 2)
+		for _, index := range indexes {
+			if index.Name != "_id_" && index.Background != expected {
+				t.Errorf("got Background %v for index %s on MongoDB %s with Foreground %v, want %v", index.Background, index.Name, info.Version, foreground, expected)
+			}
+		}
+	}
+}
+
+func TestCodec(t *testing.T) {
+	e := casbin.NewEnforcer("examples/rbac_model.conf", "examples/rbac_policy.csv")
+
+	a := NewAdapter(getDbURL()+"/casbin_codec", WithCodec(arrayCodec{})).(*adapter)
+	if err := a.SavePolicy(e.GetModel()); err != nil {
+		t.Fatalf("Expected SavePolicy() to be successful; got %v", err)
+	}
+	if err := a.RemovePolicy("p", "p", []string{"bob", "data2", "write"}); err != nil {
+		t.Errorf("Expected RemovePolicy() to be successful; got %v", err)
+	}
+
+	n, err := a.collection.Find(bson.M{"rule": []string{"alice", "data1", "read"}}).Count()
+	if err != nil || n != 1 {
+		t.Errorf("Expected the rule to be stored as an array; got %d, %v", n, err)
+	}
+
+	e.ClearPolicy()
+	if err := a.LoadPolicy(e.GetModel()); err != nil {
+		t.Fatalf("Expected LoadPolicy() to be successful; got %v", err)
+	}
+	testGetPolicy(t, e, [][]string{{"alice", "data1", "read"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}})
+}
+
+func TestAtomicSave(t *testing.T) {
+	initPolicy(t)
+
+	e := casbin.NewEnforcer("examples/rbac_model.conf", "examples/rbac_policy.csv")
+	e.RemovePolicy("bob", "data2", "write")
+
+	a := NewAdapter(getDbURL(), WithAtomicSave())
+	if err := a.SavePolicy(e.GetModel()); err != nil {
+		t.Fatalf("Expected SavePolicy() to be successful; got %v", err)
+	}
+
+	e.ClearPolicy()
+	if err := a.LoadPolicy(e.GetModel()); err != nil {
+		t.Fatalf("Expected LoadPolicy() to be successful; got %v", err)
+	}
+	testGetPolicy(t, e, [][]string{{"alice", "data1", "read"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}})
+}
+
+func TestTransactionalSave(t *testing.T) {
+	initPolicy(t)
+
+	e := casbin.NewEnforcer("examples/rbac_model.conf", "examples/rbac_policy.csv")
+	e.RemovePolicy("bob", "data2", "write")
+
+	a := NewAdapter(getDbURL(), WithTransactionalSave()).(*adapter)
+	if !a.atomicSave {
+		t.Error("Expected WithTransactionalSave() to save atomically")
+	}
+	if err := a.SavePolicy(e.GetModel()); err != nil {
+		t.Fatalf("Expected SavePolicy() to be successful; got %v", err)
+	}
+
+	e.ClearPolicy()
+	if err := a.LoadPolicy(e.GetModel()); err != nil {
+		t.Fatalf("Expected LoadPolicy() to be successful; got %v", err)
+	}
+	testGetPolicy(t, e, [][]string{{"alice", "data1", "read"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}})
+}
+
+// stagingCollections returns the names of the staging collections left in the
+// database of a.
+func stagingCollections(t *testing.T, a *adapter) []string {
+	names, err := a.collection.Database.CollectionNames()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var staging []string
+	for _, name := range names {
+		if strings.HasPrefix(name, a.collection.Name+stagingSuffix) {
+			staging = append(staging, name)
+		}
+	}
+	return staging
+}
+
+func TestConcurrentAtomicSaves(t *testing.T) {
+	initPolicy(t)
+
+	a := NewAdapter(getDbURL(), WithAtomicSave()).(*adapter)
+	var wg sync.WaitGroup
+	errs := make([]error, 4)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			e := casbin.NewEnforcer("examples/rbac_model.conf", "examples/rbac_policy.csv")
+			e.GetModel().AddPolicy("p", "p", []string{"user" + strconv.Itoa(i), "data1", "read"})
+			errs[i] = a.SavePolicy(e.GetModel())
+		}(i)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("Expected SavePolicy() %d to be successful; got %v", i, err)
+		}
+	}
+
+	// The last save wins as a whole, without any rule of the other ones.
+	if n, err := a.Count(context.Background()); err != nil || n != 6 {
+		t.Errorf("Expected the 6 rules of a single save; got %d, %v", n, err)
+	}
+	if names := stagingCollections(t, a); len(names) > 0 {
+		t.Errorf("Expected no staging collection to be left; got %v", names)
+	}
+}
+
+func TestAddRules(t *testing.T) {
+	initPolicy(t)
+
+	a := NewAdapter(getDbURL()).(*adapter)
+	if err := a.AddRules([]CasbinRule{{V0: "carol"}}); err == nil {
+		t.Error("Expected AddRules() to reject a rule without a policy type")
+	}
+
+	err := a.AddRules([]CasbinRule{
+		{PType: "p", V0: "carol", V1: "data3", V2: "read"},
+		{PType: "g", V0: "carol", V1: "data2_admin"},
+	})
+	if err != nil {
+		t.Fatalf("Expected AddRules() to be successful; got %v", err)
+	}
+
+	e := casbin.NewEnforcer("examples/rbac_model.conf", a)
+	testGetPolicy(t, e, [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}, {"carol", "data3", "read"}})
+	if !e.Enforce("carol", "data2", "write") {
+		t.Error("Expected carol to inherit data2_admin's permissions")
+	}
+}
+
+func TestSavePolicyWithDuplicates(t *testing.T) {
+	e := casbin.NewEnforcer("examples/rbac_model.conf", "examples/rbac_policy.csv")
+	model := e.GetModel()
+	model["p"]["p"].Policy = append(model["p"]["p"].Policy, []string{"alice", "data1", "read"})
+
+	a := NewAdapter(getDbURL(), WithUniqueIndex())
+	if err := a.SavePolicy(model); err != nil {
+		t.Fatalf("Expected SavePolicy() to be successful; got %v", err)
+	}
+
+	e.ClearPolicy()
+	if err := a.LoadPolicy(e.GetModel()); err != nil {
+		t.Fatalf("Expected LoadPolicy() to be successful; got %v", err)
+	}
+	testGetPolicy(t, e, [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}})
+}
+
+func TestOrphanedGroupingRules(t *testing.T) {
+	initPolicy(t)
+
+	a := NewAdapter(getDbURL()).(*adapter)
+	if err := a.AddPolicy("g", "g", []string{"bob", "data3_admin"}); err != nil {
+		t.Fatalf("Expected AddPolicy() to be successful; got %v", err)
+	}
+
+	rules, err := a.OrphanedGroupingRules()
+	if err != nil {
+		t.Fatalf("Expected OrphanedGroupingRules() to be successful; got %v", err)
+	}
+	if len(rules) != 1 || rules[0].V0 != "bob" || rules[0].V1 != "data3_admin" {
+		t.Errorf("Expected only bob's data3_admin grant to be orphaned; got %v", rules)
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	initPolicy(t)
+
+	var ops []string
+	a := NewAdapter(getDbURL()).(*adapter)
+	a.Use(func(next OpFunc) OpFunc {
+		return func(op string) error {
+			ops = append(ops, "outer:"+op)
+			return next(op)
+		}
+	})
+	a.Use(func(next OpFunc) OpFunc {
+		return func(op string) error {
+			ops = append(ops, "inner:"+op)
+			return next(op)
+		}
+	})
+
+	e := casbin.NewEnforcer("examples/rbac_model.conf", a)
+	e.AddPolicy("carol", "data3", "read")
+
+	expected := []string{"outer:LoadPolicy", "inner:LoadPolicy", "outer:AddPolicy", "inner:AddPolicy"}
+	if !util.ArrayEquals(ops, expected) {
+		t.Error("Operations: ", ops, ", supposed to be ", expected)
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	e := casbin.NewEnforcer("examples/rbac_model.conf", "examples/rbac_policy.csv")
+	key := []byte("secret")
+
+	a := NewAdapter(getDbURL(), WithChecksum(key)).(*adapter)
+	if err := a.SavePolicy(e.GetModel()); err != nil {
+		t.Fatalf("Expected SavePolicy() to be successful; got %v", err)
+	}
+
+	e.ClearPolicy()
+	if err := a.LoadPolicy(e.GetModel()); err != nil {
+		t.Fatalf("Expected LoadPolicy() to be successful; got %v", err)
+	}
+
+	if err := a.collection.Update(bson.M{"v0": "bob"}, bson.M{"$set": bson.M{"v2": "read"}}); err != nil {
+		t.Fatalf("Expected tampering with a rule to be successful; got %v", err)
+	}
+
+	e.ClearPolicy()
+	if err := a.LoadPolicy(e.GetModel()); !errors.Is(err, ErrInvalidChecksum) {
+		t.Errorf("Expected LoadPolicy() to return ErrInvalidChecksum; got %v", err)
+	}
+
+	a = NewAdapter(getDbURL(), WithChecksum(key), WithSkipInvalidChecksums()).(*adapter)
+	e.ClearPolicy()
+	if err := a.LoadPolicy(e.GetModel()); err != nil {
+		t.Fatalf("Expected LoadPolicy() to be successful; got %v", err)
+	}
+	testGetPolicy(t, e, [][]string{{"alice", "data1", "read"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}})
+}
+
+func TestRequireCollection(t *testing.T) {
+	a := NewAdapter(getDbURL()+"/casbin_missing", WithRequireCollection()).(*adapter)
+	if err := a.dropTable(); err != nil {
+		t.Fatalf("Expected dropping the collection to be successful; got %v", err)
+	}
+
+	e := casbin.NewEnforcer("examples/rbac_model.conf", "examples/rbac_policy.csv")
+	if err := a.LoadPolicy(e.GetModel()); err != ErrCollectionNotFound {
+		t.Errorf("Expected LoadPolicy() to return ErrCollectionNotFound; got %v", err)
+	}
+}
+
+func TestWriteCoalescing(t *testing.T) {
+	initPolicy(t)
+
+	a := NewAdapter(getDbURL(), WithWriteCoalescing(time.Hour, 0)).(*adapter)
+	for _, obj := range []string{"data3", "data4", "data5"} {
+		if err := a.AddPolicy("p", "p", []string{"carol", obj, "read"}); err != nil {
+			t.Fatalf("Expected AddPolicy() to be successful; got %v", err)
+		}
+	}
+
+	if n, _ := a.collection.Find(bson.M{"v0": "carol"}).Count(); n != 0 {
+		t.Errorf("Expected no rule to be written before flushing; got %d", n)
+	}
+	if err := a.Flush(); err != nil {
+		t.Fatalf("Expected Flush() to be successful; got %v", err)
+	}
+	if n, _ := a.collection.Find(bson.M{"v0": "carol"}).Count(); n != 3 {
+		t.Errorf("Expected 3 rules to be written after flushing; got %d", n)
+	}
+}
+
+func TestWriteCoalescingKeepsRulesOfFailedFlush(t *testing.T) {
+	initPolicy(t)
+
+	failing := true
+	a := NewAdapter(getDbURL(), WithWriteCoalescing(time.Hour, 0)).(*adapter)
+	a.Use(func(next OpFunc) OpFunc {
+		return func(op string) error {
+			if op == "Flush" && failing {
+				return errors.New("injected failure")
+			}
+			return next(op)
+		}
+	})
+	if err := a.AddPolicy("p", "p", []string{"carol", "data3", "read"}); err != nil {
+		t.Fatalf("Expected AddPolicy() to be successful; got %v", err)
+	}
+
+	if err := a.Flush(); err == nil {
+		t.Fatal("Expected Flush() to fail")
+	}
+	failing = false
+	if err := a.Flush(); err != nil {
+		t.Fatalf("Expected Flush() to be successful; got %v", err)
+	}
+	if n, _ := a.collection.Find(bson.M{"v0": "carol"}).Count(); n != 1 {
+		t.Errorf("Expected the rule of the failed flush to be written; got %d", n)
+	}
+}
+
+func TestNewAdapterWithUnknownURLIsUnreachable(t *testing.T) {
+	defer func() {
+		r := recover()
+		err, ok := r.(error)
+		if !ok || !(errors.Is(err, ErrUnreachable) || errors.Is(err, ErrTimeout)) {
+			t.Errorf("Expected a panic with ErrUnreachable or ErrTimeout; got %v", r)
+		}
+	}()
+
+	_ = NewAdapter("fakeserver:27017")
+}
+
+func TestPolicyCount(t *testing.T) {
+	initPolicy(t)
+
+	a := NewAdapter(getDbURL()).(*adapter)
+	if err := a.AddPolicy("p", "p", []string{"alice", "data1", "read"}); err != nil {
+		t.Fatalf("Expected AddPolicy() to be successful; got %v", err)
+	}
+
+	if n, err := a.PolicyCount("p", []string{"alice", "data1", "read"}); err != nil || n != 2 {
+		t.Errorf("Expected the duplicated rule to be counted twice; got %d, %v", n, err)
+	}
+	if n, err := a.PolicyCount("p", []string{"bob", "data2", "write"}); err != nil || n != 1 {
+		t.Errorf("Expected the rule to be counted once; got %d, %v", n, err)
+	}
+	if n, err := a.PolicyCount("p", []string{"alice", "data1"}); err != nil || n != 0 {
+		t.Errorf("Expected a prefix of a rule not to be counted; got %d, %v", n, err)
+	}
+}
+
+func TestLoadSort(t *testing.T) {
+	initPolicy(t)
+
+	a := NewAdapter(getDbURL(), WithLoadSort("-v0", "v2"))
+	e := casbin.NewEnforcer("examples/rbac_model.conf", a)
+	testGetPolicy(t, e, [][]string{{"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}, {"bob", "data2", "write"}, {"alice", "data1", "read"}})
+}
+
+// proxy forwards TCP connections to a MongoDB server and can cut them all,
+// simulating a network failure.
+type proxy struct {
+	ln     net.Listener
+	target string
+
+	mu    sync.Mutex
+	conns []net.Conn
+}
+
+func startProxy(t *testing.T, target string) *proxy {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Expected the proxy to listen; got %v", err)
+	}
+
+	p := &proxy{ln: ln, target: target}
+	go p.serve()
+	return p
+}
+
+func (p *proxy) serve() {
+	for {
+		client, err := p.ln.Accept()
+		if err != nil {
+			return
+		}
+		server, err := net.Dial("tcp", p.target)
+		if err != nil {
+			client.Close()
+			continue
+		}
+
+		p.mu.Lock()
+		p.conns = append(p.conns, client, server)
+		p.mu.Unlock()
+
+		go io.Copy(server, client)
+		go io.Copy(client, server)
+	}
+}
+
+func (p *proxy) killConnections() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, conn := range p.conns {
+		conn.Close()
+	}
+	p.conns = nil
+}
+
+func (p *proxy) close() {
+	p.ln.Close()
+	p.killConnections()
+}
+
+func TestReconnect(t *testing.T) {
+	initPolicy(t)
+
+	info, err := mgo.ParseURL(getDbURL())
+	if err != nil {
+		t.Fatalf("Expected the test URL to parse; got %v", err)
+	}
+	p := startProxy(t, info.Addrs[0])
+	defer p.close()
+
+	a := NewAdapterWithDialInfo(&mgo.DialInfo{Addrs: []string{p.ln.Addr().String()}, Direct: true, Timeout: 5 * time.Second})
+	e := casbin.NewEnforcer("examples/rbac_model.conf", a)
+
+	p.killConnections()
+
+	// The first operation after the failure may notice the broken
+	// connection, but the next one has to succeed.
+	e.LoadPolicy()
+	if err := e.LoadPolicy(); err != nil {
+		t.Fatalf("Expected LoadPolicy() to be successful after reconnecting; got %v", err)
+	}
+	testGetPolicy(t, e, [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}})
+}
+
+func TestStrictArity(t *testing.T) {
+	initPolicy(t)
+
+	a := NewAdapter(getDbURL(), WithStrictArity())
+	if err := a.AddPolicy("p", "p", []string{"alice", "data1", "read", "extra"}); err != nil {
+		t.Fatalf("Expected AddPolicy() to be successful; got %v", err)
+	}
+
+	e := casbin.NewEnforcer("examples/rbac_model.conf", "examples/rbac_policy.csv")
+	e.ClearPolicy()
+	if err := a.LoadPolicy(e.GetModel()); err == nil {
+		t.Error("Expected LoadPolicy() to fail on a rule with too many values")
+	}
+}
+
+func TestBuildFilterSelector(t *testing.T) {
+	tests := []struct {
+		fieldIndex  int
+		fieldValues []string
+		expected    bson.M
+	}{
+		{0, nil, bson.M{"ptype": "p"}},
+		{0, []string{"alice"}, bson.M{"ptype": "p", "v0": "alice"}},
+		{1, []string{"data1", "read"}, bson.M{"ptype": "p", "v1": "data1", "v2": "read"}},
+		{-1, []string{"ignored", "alice", "data1"}, bson.M{"ptype": "p", "v0": "alice", "v1": "data1"}},
+		{-3, []string{"a", "b"}, bson.M{"ptype": "p"}},
+		{4, []string{"a", "b", "c"}, bson.M{"ptype": "p", "v4": "a", "v5": "b", "vextra.0": "c"}},
+		{7, []string{"a"}, bson.M{"ptype": "p", "vextra.1": "a"}},
+	}
+
+	for _, test := range tests {
+		selector := BuildFilterSelector("p", test.fieldIndex, test.fieldValues...)
+		if !reflect.DeepEqual(selector, test.expected) {
+			t.Errorf("BuildFilterSelector(%d, %v) = %v, supposed to be %v", test.fieldIndex, test.fieldValues, selector, test.expected)
+		}
+	}
+}
+
+func TestSavePolicyKeepsIndexes(t *testing.T) {
+	e := casbin.NewEnforcer("examples/rbac_model.conf", "examples/rbac_policy.csv")
+
+	for _, opts := range [][]Option{{WithUniqueIndex()}, {WithUniqueIndex(), WithAtomicSave()}} {
+		a := NewAdapter(getDbURL(), opts...).(*adapter)
+		for i := 0; i < 2; i++ {
+			if err := a.SavePolicy(e.GetModel()); err != nil {
+				t.Fatalf("Expected SavePolicy() to be successful; got %v", err)
+			}
+
+			problems, err := a.CheckIndexes(context.Background())
+			if err != nil {
+				t.Fatalf("Expected CheckIndexes() to be successful; got %v", err)
+			}
+			if len(problems) > 0 {
+				t.Errorf("Expected the indexes to survive SavePolicy(); got %v", problems)
+			}
+		}
+	}
+}
+
+func TestMigrator(t *testing.T) {
+	initPolicy(t)
+
+	src := NewAdapter(getDbURL())
+	dst := NewAdapter(getDbURL() + "/casbin_migrated").(*adapter)
+	if err := dst.dropTable(); err != nil {
+		t.Fatalf("Expected dropping the destination to be successful; got %v", err)
+	}
+
+	m, err := NewMigrator(src, dst)
+	if err != nil {
+		t.Fatalf("Expected NewMigrator() to be successful; got %v", err)
+	}
+	m.BatchSize = 2
+	interrupted := errors.New("interrupted")
+	m.Checkpoint = func(bson.ObjectId) error { return interrupted }
+	if err := m.Run(context.Background()); err != interrupted {
+		t.Fatalf("Expected the migration to be interrupted; got %v", err)
+	}
+
+	resumed, _ := NewMigrator(src, dst)
+	resumed.BatchSize = 2
+	resumed.LastID = m.LastID
+	if err := resumed.Run(context.Background()); err != nil {
+		t.Fatalf("Expected the resumed migration to be successful; got %v", err)
+	}
+
+	e := casbin.NewEnforcer("examples/rbac_model.conf", dst)
+	testGetPolicy(t, e, [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}})
+}
+
+func TestRolesForUser(t *testing.T) {
+	initPolicy(t)
+
+	a := NewAdapter(getDbURL()).(*adapter)
+	roles, err := a.RolesForUser("alice", "")
+	if err != nil {
+		t.Fatalf("Expected RolesForUser() to be successful; got %v", err)
+	}
+	if !util.ArrayEquals(roles, []string{"data2_admin"}) {
+		t.Error("Roles for alice: ", roles, ", supposed to be ", []string{"data2_admin"})
+	}
+}
+
+func TestUsersForRole(t *testing.T) {
+	initPolicy(t)
+
+	a := NewAdapter(getDbURL()).(*adapter)
+	users, err := a.UsersForRole("data2_admin", "g")
+	if err != nil {
+		t.Fatalf("Expected UsersForRole() to be successful; got %v", err)
+	}
+	if !util.ArrayEquals(users, []string{"alice"}) {
+		t.Error("Users for data2_admin: ", users, ", supposed to be ", []string{"alice"})
+	}
+}
+
+func TestWatchBackoffDelay(t *testing.T) {
+	b := WatchBackoff{Initial: 100 * time.Millisecond, Max: time.Second}.withDefaults()
+	for attempt, max := range []time.Duration{
+		100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond,
+		800 * time.Millisecond, time.Second, time.Second,
+	} {
+		for i := 0; i < 100; i++ {
+			if d := b.delay(attempt); d < max/2 || d > max {
+				t.Fatalf("attempt %d: got delay %v, want between %v and %v", attempt, d, max/2, max)
+			}
+		}
+	}
+	if b.MaxElapsed != defaultWatchBackoff.MaxElapsed {
+		t.Errorf("got MaxElapsed %v, want the default %v", b.MaxElapsed, defaultWatchBackoff.MaxElapsed)
+	}
+}
+
+func TestEnsureDatabase(t *testing.T) {
+	session, err := mgo.Dial(getDbURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	db := session.DB("casbin_ensure_test")
+	if err := db.DropDatabase(); err != nil {
+		t.Fatal(err)
+	}
+	defer db.DropDatabase()
+
+	a := NewAdapterWithDB(db).(*adapter)
+	if err := db.DropDatabase(); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := a.EnsureDatabase(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	names, err := db.CollectionNames()
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, name := range names {
+		found = found || name == "casbin_rule"
+	}
+	if !found {
+		t.Fatalf("got collections %v, want casbin_rule among them", names)
+	}
+	problems, err := a.CheckIndexes(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 0 {
+		t.Errorf("got index problems %v, want none", problems)
+	}
+}
+
+func TestPolicyStats(t *testing.T) {
+	initPolicy(t)
+
+	a := NewAdapter(getDbURL()).(*adapter)
+	stats, err := a.PolicyStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := PolicyStats{
+		Rules:         map[string]int64{"p": 4, "g": 1},
+		Subjects:      3,
+		Objects:       2,
+		AverageTokens: 2.8,
+	}
+	if !reflect.DeepEqual(stats, want) {
+		t.Errorf("got %+v, want %+v", stats, want)
+	}
+}
+
+func TestUpsertKey(t *testing.T) {
+	initPolicy(t)
+
+	a := NewAdapter(getDbURL(), WithUpsertKey(0, 1)).(*adapter)
+	if err := a.AddPolicy("p", "p", []string{"alice", "data1", "write"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.AddPolicy("p", "p", []string{"carol", "data1", "read"}); err != nil {
+		t.Fatal(err)
+	}
+
+	e := casbin.NewEnforcer("examples/rbac_model.conf", a)
+	testGetPolicy(t, e, [][]string{{"alice", "data1", "write"}, {"bob", "data2", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}, {"carol", "data1", "read"}})
+}
+
+func TestDiffCollections(t *testing.T) {
+	initPolicy(t)
+
+	src := NewAdapter(getDbURL()).(*adapter)
+	dst := NewAdapter(getDbURL() + "/casbin_diff").(*adapter)
+	if err := dst.dropTable(); err != nil {
+		t.Fatal(err)
+	}
+	err := src.CopyTo(dst, func(line CasbinRule) (CasbinRule, error) {
+		if line.V0 == "bob" {
+			line.V0 = "robert"
+		}
+		return line, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	onlyHere, onlyThere, err := src.DiffCollections(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(onlyHere) != 1 || !reflect.DeepEqual(policyTokens(onlyHere[0]), []string{"bob", "data2", "write"}) {
+		t.Errorf("got only here %v, want bob's rule", onlyHere)
+	}
+	if len(onlyThere) != 1 || !reflect.DeepEqual(policyTokens(onlyThere[0]), []string{"robert", "data2", "write"}) {
+		t.Errorf("got only there %v, want robert's rule", onlyThere)
+	}
+
+	if _, _, err := src.DiffCollections(nil); err == nil {
+		t.Error("Expected DiffCollections() to reject an adapter which is not a MongoDB adapter")
+	}
+}
+
+func TestContextConcerns(t *testing.T) {
+	a := NewAdapter(getDbURL()).(*adapter)
+	ctx := ContextWithWriteConcern(context.Background(), mgo.Safe{WMode: "majority"})
+	ctx = ContextWithReadConcern(ctx, "majority")
+
+	c, release, err := a.collectionFor(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+
+	safe := c.Database.Session.Safe()
+	if safe == nil || safe.WMode != "majority" || safe.RMode != "majority" {
+		t.Errorf("got %+v, want majority reads and writes", safe)
+	}
+	if a.session.Safe().WMode == "majority" {
+		t.Error("expected the adapter's session to be left as it is")
+	}
+}
+
+func TestTagFiltered(t *testing.T) {
+	initPolicy(t)
+
+	a := NewAdapter(getDbURL()).(*adapter)
+	n, err := a.TagFiltered("p", "p", 1, []string{"data2"}, bson.M{"reviewedBy": "carol"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Errorf("got %d tagged rules, want 3", n)
+	}
+
+	tagged, err := a.collection.Find(bson.M{"reviewedBy": "carol"}).Count()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tagged != 3 {
+		t.Errorf("got %d rules with the tag, want 3", tagged)
+	}
+}
+
+func TestLoadChangedSince(t *testing.T) {
+	initPolicy(t)
+
+	a := NewAdapter(getDbURL(), WithTimestamps()).(*adapter)
+	e := casbin.NewEnforcer("examples/rbac_model.conf", a)
+
+	since := time.Now().Add(-time.Second)
+	if err := a.AddPolicy("p", "p", []string{"carol", "data3", "read"}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := a.LoadChangedSince(e.GetModel(), since); err != nil {
+			t.Fatal(err)
+		}
+	}
+	testGetPolicy(t, e, [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}, {"carol", "data3", "read"}})
+}
+
+func TestLoadPolicyFailureLeavesModel(t *testing.T) {
+	initPolicy(t)
+
+	a := NewAdapter(getDbURL()).(*adapter)
+	e := casbin.NewEnforcer("examples/rbac_model.conf", "examples/rbac_policy.csv")
+
+	a.SetMaxLoadCount(3)
+	e.ClearPolicy()
+	if err := a.LoadPolicy(e.GetModel()); err != ErrTooManyRules {
+		t.Fatalf("Expected LoadPolicy() to return ErrTooManyRules; got %v", err)
+	}
+	testGetPolicy(t, e, [][]string{})
+}
+
+func TestFallbackCodecs(t *testing.T) {
+	initPolicy(t)
+
+	legacy := NewAdapter(getDbURL(), WithCodec(arrayCodec{}))
+	if err := legacy.AddPolicy("p", "p", []string{"carol", "data3", "read"}); err != nil {
+		t.Fatalf("Expected AddPolicy() to be successful; got %v", err)
+	}
+
+	a := NewAdapter(getDbURL(), WithFallbackCodecs(arrayCodec{}))
+	e := casbin.NewEnforcer("examples/rbac_model.conf", a)
+	testGetPolicy(t, e, [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}, {"carol", "data3", "read"}})
+}
+
+func TestCloseStopsBackgroundActivities(t *testing.T) {
+	a := NewAdapter(getDbURL()).(*adapter)
+
+	stopped := make(chan struct{})
+	a.goBackground(context.Background(), func(ctx context.Context) error {
+		<-ctx.Done()
+		close(stopped)
+		return ctx.Err()
+	})
+	boom := errors.New("boom")
+	a.goBackground(context.Background(), func(ctx context.Context) error {
+		<-ctx.Done()
+		return boom
+	})
+
+	err := a.close()
+	select {
+	case <-stopped:
+	default:
+		t.Error("Expected close() to wait for background activities")
+	}
+	if errs, ok := err.(closeError); !ok || len(errs) != 1 || errs[0] != boom {
+		t.Errorf("Expected close() to report the failed activity; got %v", err)
+	}
+	if !errors.Is(err, boom) {
+		t.Errorf("Expected the error of close() to match the failed activity's; got %v", err)
+	}
+}
+
+func TestNewAdapterWithError(t *testing.T) {
+	if _, err := NewAdapterWithError("localhost:40001?foo=1&bar=2"); err == nil {
+		t.Error("Expected an error for an invalid URL")
+	}
+	if _, err := NewAdapterWithError("fakeserver:27017"); !errors.Is(err, ErrUnreachable) && !errors.Is(err, ErrTimeout) {
+		t.Errorf("Expected ErrUnreachable or ErrTimeout; got %v", err)
+	}
+
+	a, err := NewAdapterWithError(getDbURL())
+	if err != nil {
+		t.Fatalf("Expected NewAdapterWithError() to be successful; got %v", err)
+	}
+	if err := a.(io.Closer).Close(); err != nil {
+		t.Errorf("Expected Close() to be successful; got %v", err)
+	}
+}
+
+func TestCollectionName(t *testing.T) {
+	initPolicy(t)
+
+	a := NewAdapter(getDbURL(), WithCollectionName("casbin_rule_tenant")).(*adapter)
+	if err := a.dropTable(); err != nil {
+		t.Fatalf("Expected dropping the collection to be successful; got %v", err)
+	}
+	if err := a.AddPolicy("p", "p", []string{"carol", "data3", "read"}); err != nil {
+		t.Fatalf("Expected AddPolicy() to be successful; got %v", err)
+	}
+
+	e := casbin.NewEnforcer("examples/rbac_model.conf", a)
+	testGetPolicy(t, e, [][]string{{"carol", "data3", "read"}})
+
+	e = casbin.NewEnforcer("examples/rbac_model.conf", NewAdapter(getDbURL()))
+	testGetPolicy(t, e, [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}})
+}
+
+func TestDatabaseName(t *testing.T) {
+	a := NewAdapter(getDbURL()+"/casbin", WithDatabaseName("casbin_other")).(*adapter)
+	if a.collection.Database.Name != "casbin_other" {
+		t.Fatalf("Expected the rules to be stored in casbin_other; got %s", a.collection.Database.Name)
+	}
+	if err := a.dropTable(); err != nil {
+		t.Fatalf("Expected dropping the collection to be successful; got %v", err)
+	}
+	if err := a.AddPolicy("p", "p", []string{"carol", "data3", "read"}); err != nil {
+		t.Fatalf("Expected AddPolicy() to be successful; got %v", err)
+	}
+
+	e := casbin.NewEnforcer("examples/rbac_model.conf", a)
+	testGetPolicy(t, e, [][]string{{"carol", "data3", "read"}})
+}
+
+func TestContextVariants(t *testing.T) {
+	initPolicy(t)
+
+	a := NewAdapter(getDbURL()).(*adapter)
+	e := casbin.NewEnforcer("examples/rbac_model.conf", "examples/rbac_policy.csv")
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := a.LoadPolicyCtx(cancelled, e.GetModel()); err != context.Canceled {
+		t.Errorf("Expected LoadPolicyCtx() to return context.Canceled; got %v", err)
+	}
+	if err := a.AddPolicyCtx(cancelled, "p", "p", []string{"carol", "data3", "read"}); err != context.Canceled {
+		t.Errorf("Expected AddPolicyCtx() to return context.Canceled; got %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := a.AddPolicyCtx(ctx, "p", "p", []string{"carol", "data3", "read"}); err != nil {
+		t.Fatalf("Expected AddPolicyCtx() to be successful; got %v", err)
+	}
+	if err := a.RemoveFilteredPolicyCtx(ctx, "p", "p", 0, "data2_admin"); err != nil {
+		t.Fatalf("Expected RemoveFilteredPolicyCtx() to be successful; got %v", err)
+	}
+	e.ClearPolicy()
+	if err := a.LoadPolicyCtx(ctx, e.GetModel()); err != nil {
+		t.Fatalf("Expected LoadPolicyCtx() to be successful; got %v", err)
+	}
+	testGetPolicy(t, e, [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}, {"carol", "data3", "read"}})
+}
+
+func TestAddRemovePolicies(t *testing.T) {
+	initPolicy(t)
+
+	a := NewAdapter(getDbURL()).(*adapter)
+	rules := make([][]string, 1000)
+	for i := range rules {
+		rules[i] = []string{"user" + strconv.Itoa(i), "data", "read"}
+	}
+	if err := a.AddPolicies("p", "p", rules); err != nil {
+		t.Fatalf("Expected AddPolicies() to be successful; got %v", err)
+	}
+	if n, err := a.collection.Find(bson.M{"ptype": "p", "v1": "data"}).Count(); err != nil || n != 1000 {
+		t.Fatalf("Expected 1000 added rules; got %d, %v", n, err)
+	}
+
+	if err := a.RemovePolicies("p", "p", rules[:999]); err != nil {
+		t.Fatalf("Expected RemovePolicies() to be successful; got %v", err)
+	}
+	if n, err := a.collection.Find(bson.M{"ptype": "p", "v1": "data"}).Count(); err != nil || n != 1 {
+		t.Errorf("Expected 1 remaining rule; got %d, %v", n, err)
+	}
+}
+
+func TestUpdatePolicy(t *testing.T) {
+	initPolicy(t)
+
+	a := NewAdapter(getDbURL()).(*adapter)
+	if err := a.UpdatePolicy("p", "p", []string{"alice", "data1", "read"}, []string{"alice", "data1", "write"}); err != nil {
+		t.Fatalf("Expected UpdatePolicy() to be successful; got %v", err)
+	}
+	if err := a.UpdatePolicy("p", "p", []string{"nobody", "data1", "read"}, []string{"alice", "data1", "write"}); !errors.Is(err, ErrPolicyNotFound) {
+		t.Errorf("Expected ErrPolicyNotFound; got %v", err)
+	}
+
+	err := a.UpdatePolicies("p", "p",
+		[][]string{{"bob", "data2", "write"}, {"nobody", "data2", "write"}},
+		[][]string{{"bob", "data3", "write"}, {"carol", "data2", "write"}})
+	if !errors.Is(err, ErrPolicyNotFound) {
+		t.Errorf("Expected ErrPolicyNotFound; got %v", err)
+	}
+
+	e := casbin.NewEnforcer("examples/rbac_model.conf", a)
+	testGetPolicy(t, e, [][]string{{"alice", "data1", "write"}, {"bob", "data3", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}})
+}
+
+func TestTimeout(t *testing.T) {
+	start := time.Now()
+	if _, err := NewAdapterWithError("10.255.255.1:27017", WithTimeout(time.Second)); err == nil {
+		t.Fatal("Expected connecting to an unroutable address to fail")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Expected the connection attempt to give up after about a second; took %v", elapsed)
+	}
+}
+
+func TestCloseLeavesGivenSessionOpen(t *testing.T) {
+	session, err := mgo.Dial(getDbURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+
+	a := NewAdapterWithDB(session.DB("casbin"))
+	if err := a.(io.Closer).Close(); err != nil {
+		t.Fatalf("Expected Close() to be successful; got %v", err)
+	}
+	if err := session.Ping(); err != nil {
+		t.Errorf("Expected the given session to remain usable; got %v", err)
+	}
+}
+
+func TestLongRules(t *testing.T) {
+	initPolicy(t)
+
+	a := NewAdapter(getDbURL()).(*adapter)
+	long := []string{"alice", "data1", "read", "a3", "a4", "a5", "a6", "a7"}
+	other := []string{"alice", "data1", "read", "a3", "a4", "a5", "b6", "a7"}
+	for _, rule := range [][]string{long, other} {
+		if err := a.AddPolicy("p", "p", rule); err != nil {
+			t.Fatalf("Expected AddPolicy() to be successful; got %v", err)
+		}
+	}
+
+	var line CasbinRule
+	if err := a.collection.Find(bson.M{"vextra": []string{"a6", "a7"}}).One(&line); err != nil {
+		t.Fatalf("Expected the values beyond the sixth one to be stored; got %v", err)
+	}
+	if tokens := policyTokens(line); !reflect.DeepEqual(tokens, long) {
+		t.Errorf("Expected %v; got %v", long, tokens)
+	}
+
+	if err := a.RemoveFilteredPolicy("p", "p", 6, "b6"); err != nil {
+		t.Fatalf("Expected RemoveFilteredPolicy() to be successful; got %v", err)
+	}
+	if n, err := a.collection.Find(bson.M{"vextra": bson.M{"$exists": true}}).Count(); err != nil || n != 1 {
+		t.Errorf("Expected one long rule to remain; got %d, %v", n, err)
+	}
+}
+
+func TestIndexOptions(t *testing.T) {
+	session, err := mgo.Dial(getDbURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	db := session.DB("casbin_index_test")
+	defer db.DropDatabase()
+
+	compound := mgo.Index{Key: []string{"ptype", "v0"}}
+	for _, test := range []struct {
+		opts     []Option
+		expected int
+	}{
+		{[]Option{WithSkipIndexCreation()}, 1},
+		{[]Option{WithIndexes(compound)}, 2},
+	} {
+		if err := db.DropDatabase(); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.C("casbin_rule").Create(&mgo.CollectionInfo{}); err != nil {
+			t.Fatal(err)
+		}
+		session.ResetIndexCache()
+
+		a := NewAdapterWithDB(db, test.opts...).(*adapter)
+		indexes, err := a.collection.Indexes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(indexes) != test.expected {
+			t.Errorf("Expected %d indexes; got %v", test.expected, indexes)
+		}
+	}
+}
+
+func TestCompoundRuleIndex(t *testing.T) {
+	initPolicy(t)
+
+	a := NewAdapter(getDbURL()).(*adapter)
+	if err := a.collection.EnsureIndexKey("v0"); err != nil {
+		t.Fatal(err)
+	}
+
+	indexes, err := a.collection.Indexes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, index := range indexes {
+		found = found || indexKey(index) == "ptype,v0,v1,v2,v3,v4,v5"
+	}
+	if !found {
+		t.Errorf("Expected a compound index on the rule fields; got %v", indexes)
+	}
+
+	problems, err := a.CheckIndexes(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) > 0 {
+		t.Errorf("Expected legacy indexes to be tolerated; got %v", problems)
+	}
+}
+
+func TestStoredFieldNames(t *testing.T) {
+	initPolicy(t)
+
+	a := NewAdapter(getDbURL()).(*adapter)
+	if err := a.AddPolicy("p", "p", []string{"carol", "data3", "read"}); err != nil {
+		t.Fatalf("Expected AddPolicy() to be successful; got %v", err)
+	}
+
+	var doc bson.M
+	if err := a.collection.Find(bson.M{"v0": "carol"}).One(&doc); err != nil {
+		t.Fatalf("Expected the rule to be found by its lowercase fields; got %v", err)
+	}
+	for _, field := range []string{"ptype", "v0", "v1", "v2", "v3", "v4", "v5"} {
+		if _, ok := doc[field]; !ok {
+			t.Errorf("Expected the stored rule to have a %q field; got %v", field, doc)
+		}
+	}
+
+	if err := a.RemoveFilteredPolicy("p", "p", 0, "carol"); err != nil {
+		t.Fatalf("Expected RemoveFilteredPolicy() to be successful; got %v", err)
+	}
+	if n, err := a.collection.Find(bson.M{"v0": "carol"}).Count(); err != nil || n != 0 {
+		t.Errorf("Expected the rule to be removed; got %d, %v", n, err)
+	}
+}
+
+func TestNewAdapterWithSession(t *testing.T) {
+	session, err := mgo.DialWithTimeout(getDbURL(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	session.SetPoolLimit(8)
+
+	a, err := NewAdapterWithSession(session, "casbin_session", "rules")
+	if err != nil {
+		t.Fatalf("Expected NewAdapterWithSession() to be successful; got %v", err)
+	}
+	if c := a.(*adapter).collection; c.FullName != "casbin_session.rules" {
+		t.Errorf("Expected the rules to be stored in casbin_session.rules; got %s", c.FullName)
+	}
+
+	if err := a.(io.Closer).Close(); err != nil {
+		t.Fatalf("Expected Close() to be successful; got %v", err)
+	}
+	if err := session.Ping(); err != nil {
+		t.Errorf("Expected the given session to remain usable; got %v", err)
+	}
+}
+
+func TestRemovePolicyExactMatch(t *testing.T) {
+	initPolicy(t)
+
+	a := NewAdapter(getDbURL()).(*adapter)
+	if err := a.AddPolicy("p", "p", []string{"alice", "data1"}); err != nil {
+		t.Fatalf("Expected AddPolicy() to be successful; got %v", err)
+	}
+	// A rule written by another tool, without its empty fields.
+	if err := a.collection.Insert(bson.M{"ptype": "p", "v0": "bob", "v1": "data2"}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, rule := range [][]string{{"alice", "data1"}, {"bob", "data2"}} {
+		if err := a.RemovePolicy("p", "p", rule); err != nil {
+			t.Fatalf("Expected RemovePolicy() to be successful; got %v", err)
+		}
+	}
+
+	e := casbin.NewEnforcer("examples/rbac_model.conf", a)
+	testGetPolicy(t, e, [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}})
+	if n, err := a.collection.Find(bson.M{"v2": bson.M{"$in": []interface{}{"", nil}}, "ptype": "p"}).Count(); err != nil || n != 0 {
+		t.Errorf("Expected the short rules to be removed; got %d, %v", n, err)
+	}
+}
+
+func TestWriteConcern(t *testing.T) {
+	initPolicy(t)
+
+	a := NewAdapter(getDbURL(), WithWriteConcern(mgo.Safe{WMode: "majority", J: true})).(*adapter)
+	if safe := a.session.Safe(); safe == nil || safe.WMode != "majority" || !safe.J {
+		t.Errorf("Expected majority journaled writes; got %+v", safe)
+	}
+	if err := a.AddPolicy("p", "p", []string{"carol", "data3", "read"}); err != nil {
+		t.Fatalf("Expected AddPolicy() to be successful; got %v", err)
+	}
+
+	c, release, err := a.collectionFor(ContextWithWriteConcern(context.Background(), mgo.Safe{W: 1}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+	if safe := c.Database.Session.Safe(); safe == nil || safe.W != 1 || safe.WMode != "" {
+		t.Errorf("Expected the context to override the write concern; got %+v", safe)
+	}
+}
+
+func TestLoadReadPreference(t *testing.T) {
+	initPolicy(t)
+
+	a := NewAdapter(getDbURL(), WithLoadReadPreference(mgo.Nearest)).(*adapter)
+	e := casbin.NewEnforcer("examples/rbac_model.conf", a)
+	testGetPolicy(t, e, [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}})
+
+	if mode := a.session.Mode(); mode != mgo.Primary {
+		t.Errorf("Expected the adapter's session to keep reading from the primary; got mode %v", mode)
+	}
+}
+
+func TestRemoveFilteredGroupingPolicy(t *testing.T) {
+	initPolicy(t)
+
+	a := NewAdapter(getDbURL()).(*adapter)
+	for _, rule := range [][]string{{"alice", "data2_admin"}, {"bob", "data2_admin"}} {
+		if err := a.AddPolicy("g", "g2", rule); err != nil {
+			t.Fatalf("Expected AddPolicy() to be successful; got %v", err)
+		}
+	}
+
+	if err := a.RemoveFilteredPolicy("g", "g", 1, "data2_admin"); err != nil {
+		t.Fatalf("Expected RemoveFilteredPolicy() to be successful; got %v", err)
+	}
+	if n, err := a.collection.Find(bson.M{"ptype": "g"}).Count(); err != nil || n != 0 {
+		t.Errorf("Expected the g rules to be removed; got %d, %v", n, err)
+	}
+	if n, err := a.collection.Find(bson.M{"ptype": "g2"}).Count(); err != nil || n != 2 {
+		t.Errorf("Expected the g2 rules to be kept; got %d, %v", n, err)
+	}
+
+	if err := a.RemoveFilteredPolicy("g", "g2", 0, "bob"); err != nil {
+		t.Fatalf("Expected RemoveFilteredPolicy() to be successful; got %v", err)
+	}
+	if n, err := a.collection.Find(bson.M{"ptype": "g2"}).Count(); err != nil || n != 1 {
+		t.Errorf("Expected only alice's g2 rule to be kept; got %d, %v", n, err)
+	}
+	if n, err := a.collection.Find(bson.M{"ptype": "p"}).Count(); err != nil || n != 4 {
+		t.Errorf("Expected the p rules to be kept; got %d, %v", n, err)
+	}
+}
+
+func TestIgnoreDuplicates(t *testing.T) {
+	initPolicy(t)
+
+	a := NewAdapter(getDbURL(), WithIgnoreDuplicates()).(*adapter)
+	for i := 0; i < 2; i++ {
+		if err := a.AddPolicy("p", "p", []string{"carol", "data1", "read"}); err != nil {
+			t.Fatalf("Expected AddPolicy() to be successful; got %v", err)
+		}
+	}
+	if n, err := a.collection.Find(bson.M{"ptype": "p", "v0": "carol"}).Count(); err != nil || n != 1 {
+		t.Errorf("Expected the rule to be stored once; got %d, %v", n, err)
+	}
+
+	rules := [][]string{{"alice", "data1", "read"}, {"carol", "data2", "read"}, {"carol", "data1", "read"}}
+	if err := a.AddPolicies("p", "p", rules); err != nil {
+		t.Fatalf("Expected AddPolicies() to be successful; got %v", err)
+	}
+
+	e := casbin.NewEnforcer("examples/rbac_model.conf", a)
+	testGetPolicy(t, e, [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}, {"carol", "data1", "read"}, {"carol", "data2", "read"}})
+}
+
+func TestCollection(t *testing.T) {
+	initPolicy(t)
+
+	a := NewAdapter(getDbURL(), WithCollectionName("casbin_rule_collection")).(*adapter)
+	if err := a.AddPolicy("p", "p", []string{"alice", "data1", "read"}); err != nil {
+		t.Fatalf("Expected AddPolicy() to be successful; got %v", err)
+	}
+
+	c := a.Collection()
+	if c.Name != "casbin_rule_collection" {
+		t.Errorf("Expected the configured collection; got %s", c.Name)
+	}
+	if n, err := c.Find(bson.M{"ptype": "p", "v0": "alice"}).Count(); err != nil || n != 1 {
+		t.Errorf("Expected to find the added rule; got %d, %v", n, err)
+	}
+	if err := c.DropCollection(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestInterleavedRuleLengths(t *testing.T) {
+	a := NewAdapter(getDbURL(), WithCollectionName("casbin_rule_lengths"), WithLoadSort("_id")).(*adapter)
+	if err := a.dropTable(); err != nil {
+		t.Fatal(err)
+	}
+	defer a.dropTable()
+
+	rules := [][]string{
+		{"alice", "data1", "read", "a3", "a4", "a5", "a6", "a7"},
+		{"bob"},
+		{"carol", "data2", "write", "c3"},
+		{"dave", "data3"},
+		{"erin", "data4", "read", "e3", "e4", "e5", "e6"},
+		{"frank", "data5", "read"},
+	}
+	for _, rule := range rules {
+		// Written like another tool would, without the empty fields.
+		doc := bson.D{{Name: "_id", Value: bson.NewObjectId()}, {Name: "ptype", Value: "p"}}
+		for j, value := range rule {
+			if j < 6 {
+				doc = append(doc, bson.DocElem{Name: "v" + strconv.Itoa(j), Value: value})
+			}
+		}
+		if len(rule) > 6 {
+			doc = append(doc, bson.DocElem{Name: "vextra", Value: rule[6:]})
+		}
+		if err := a.collection.Insert(doc); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	e := casbin.NewEnforcer("examples/rbac_model.conf", a)
+	testGetPolicy(t, e, rules)
+
+	dst := NewAdapter(getDbURL(), WithCollectionName("casbin_rule_lengths_copy"), WithLoadSort("_id")).(*adapter)
+	if err := dst.dropTable(); err != nil {
+		t.Fatal(err)
+	}
+	defer dst.dropTable()
+	if err := a.CopyTo(dst, nil); err != nil {
+		t.Fatalf("Expected CopyTo() to be successful; got %v", err)
+	}
+	e = casbin.NewEnforcer("examples/rbac_model.conf", dst)
+	testGetPolicy(t, e, rules)
+}
+
+func TestRetry(t *testing.T) {
+	initPolicy(t)
+
+	notMaster := &mgo.LastError{Code: 10107, Err: "not master"}
+	tests := []struct {
+		op       string
+		err      error
+		attempts int
+	}{
+		{"AddPolicy", notMaster, 3},
+		{"AddPolicy", io.EOF, 1},
+		{"LoadPolicy", io.EOF, 3},
+		{"LoadPolicy", &mgo.QueryError{Code: 2, Message: "bad value"}, 1},
+	}
+
+	a := NewAdapter(getDbURL(), WithRetry(RetryPolicy{Attempts: 3, Backoff: time.Millisecond})).(*adapter)
+	for _, test := range tests {
+		calls := 0
+		err := a.runCtx(context.Background(), test.op, func(c *mgo.Collection) error {
+			calls++
+			return test.err
+		})
+		if err != test.err || calls != test.attempts {
+			t.Errorf("%s failing with %v: expected %d attempts; got %d, %v", test.op, test.err, test.attempts, calls, err)
+		}
+	}
+
+	calls := 0
+	err := a.runCtx(context.Background(), "AddPolicy", func(c *mgo.Collection) error {
+		if calls++; calls == 1 {
+			return notMaster
+		}
+		return a.addPolicy(c, "p", "p", []string{"carol", "data1", "read"})
+	})
+	if err != nil {
+		t.Fatalf("Expected AddPolicy() to succeed once retried; got %v", err)
+	}
+	e := casbin.NewEnforcer("examples/rbac_model.conf", a)
+	testGetPolicy(t, e, [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}, {"carol", "data1", "read"}})
+}
+
+func TestChangeHook(t *testing.T) {
+	initPolicy(t)
+
+	var changes []PolicyChange
+	a := NewAdapter(getDbURL(), WithChangeHook(func(change PolicyChange) {
+		changes = append(changes, change)
+	})).(*adapter)
+
+	if err := a.AddPolicy("p", "p", []string{"carol", "data1", "read"}); err != nil {
+		t.Fatalf("Expected AddPolicy() to be successful; got %v", err)
+	}
+	if err := a.RemoveFilteredPolicy("p", "p", 0, "carol"); err != nil {
+		t.Fatalf("Expected RemoveFilteredPolicy() to be successful; got %v", err)
+	}
+	if err := a.UpdatePolicy("p", "p", []string{"dave", "data1", "read"}, []string{"dave", "data2", "read"}); err == nil {
+		t.Fatal("Expected UpdatePolicy() of a missing rule to fail")
+	}
+
+	expected := []PolicyChange{
+		{Op: "AddPolicy", Sec: "p", PType: "p", Rules: [][]string{{"carol", "data1", "read"}}},
+		{Op: "RemoveFilteredPolicy", Sec: "p", PType: "p", FieldValues: []string{"carol"}},
+	}
+	if !reflect.DeepEqual(changes, expected) {
+		t.Errorf("Expected changes %v; got %v", expected, changes)
+	}
+}
+
+func TestAddPolicyWithTTL(t *testing.T) {
+	initPolicy(t)
+
+	a := NewAdapter(getDbURL(), WithTTLIndex()).(*adapter)
+	defer a.collection.DropIndex(expireAtField)
+
+	before := time.Now()
+	if err := a.AddPolicyWithTTL("p", "p", []string{"carol", "data1", "read"}, time.Hour); err != nil {
+		t.Fatalf("Expected AddPolicyWithTTL() to be successful; got %v", err)
+	}
+
+	var doc struct {
+		ExpireAt time.Time `bson:"expireAt"`
+	}
+	if err := a.collection.Find(bson.M{"v0": "carol"}).One(&doc); err != nil {
+		t.Fatal(err)
+	}
+	if doc.ExpireAt.Before(before.Add(time.Hour-time.Second)) || doc.ExpireAt.After(time.Now().Add(time.Hour)) {
+		t.Errorf("Expected the rule to expire in an hour; got %v", doc.ExpireAt)
+	}
+	if n, err := a.collection.Find(bson.M{expireAtField: bson.M{"$exists": true}}).Count(); err != nil || n != 1 {
+		t.Errorf("Expected only the temporary rule to expire; got %d, %v", n, err)
+	}
+
+	problems, err := a.CheckIndexes(context.Background())
+	if err != nil || len(problems) != 0 {
+		t.Errorf("Expected the TTL index to be created; got %v, %v", problems, err)
+	}
+
+	e := casbin.NewEnforcer("examples/rbac_model.conf", a)
+	testGetPolicy(t, e, [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}, {"carol", "data1", "read"}})
+}
+
+// cancellingCodec cancels a context, once given one, when it encodes a rule.
+type cancellingCodec struct {
+	fieldCodec
+	cancel context.CancelFunc
+}
+
+func (c *cancellingCodec) Encode(sec string, ptype string, rule []string) (interface{}, error) {
+	if c.cancel != nil {
+		c.cancel()
+	}
+	return c.fieldCodec.Encode(sec, ptype, rule)
+}
+
+func TestSavePolicyCtxCancelled(t *testing.T) {
+	for _, atomic := range []bool{false, true} {
+		initPolicy(t)
+
+		codec := &cancellingCodec{}
+		opts := []Option{WithCodec(codec)}
+		if atomic {
+			opts = append(opts, WithAtomicSave())
+		}
+		a := NewAdapter(getDbURL(), opts...).(*adapter)
+
+		e := casbin.NewEnforcer("examples/rbac_model.conf", a)
+		e.GetModel().AddPolicy("p", "p", []string{"carol", "data1", "read"})
+
+		ctx, cancel := context.WithCancel(context.Background())
+		codec.cancel = cancel
+		if err := a.SavePolicyCtx(ctx, e.GetModel()); err != context.Canceled {
+			t.Errorf("Expected SavePolicyCtx() to be cancelled; got %v", err)
+		}
+
+		e.ClearPolicy()
+		if err := a.LoadPolicy(e.GetModel()); err != nil {
+			t.Fatalf("Expected LoadPolicy() to be successful; got %v", err)
+		}
+		testGetPolicy(t, e, [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}})
+		if names := stagingCollections(t, a); len(names) > 0 {
+			t.Errorf("Expected the cancelled save to drop its staging collection; got %v", names)
+		}
+	}
+}
+
+func TestCredential(t *testing.T) {
+	cred := mgo.Credential{Username: "nobody", Password: "p@ss:/word%", Source: "admin"}
+	_, err := NewAdapterWithError(getDbURL(), WithCredential(cred))
+	if !errors.Is(err, ErrAuth) {
+		t.Errorf("Expected an authentication error; got %v", err)
+	}
+}
+
+func TestCount(t *testing.T) {
+	initPolicy(t)
+
+	a := NewAdapter(getDbURL()).(*adapter)
+	if n, err := a.Count(context.Background()); err != nil || n != 5 {
+		t.Errorf("Expected 5 rules; got %d, %v", n, err)
+	}
+
+	counts, err := a.CountByPType(context.Background())
+	if err != nil {
+		t.Fatalf("Expected CountByPType() to be successful; got %v", err)
+	}
+	if expected := map[string]int64{"p": 4, "g": 1}; !reflect.DeepEqual(counts, expected) {
+		t.Errorf("Expected %v; got %v", expected, counts)
+	}
+}
+
+func TestIndexCollation(t *testing.T) {
+	session, err := mgo.Dial(getDbURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	db := session.DB("casbin_index_test")
+	defer db.DropDatabase()
+	if err := db.DropDatabase(); err != nil {
+		t.Fatal(err)
+	}
+	session.ResetIndexCache()
+
+	collation := &mgo.Collation{Locale: "en", Strength: 2}
+	a := NewAdapterWithDB(db, WithIndexOptions(IndexOptions{Foreground: true, Collation: collation})).(*adapter)
+	indexes, err := a.collection.Indexes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, index := range indexes {
+		if indexKey(index) == indexKey(ruleIndex) {
+			if index.Collation == nil || index.Collation.Locale != "en" || index.Collation.Strength != 2 {
+				t.Errorf("Expected the rule index to have the collation; got %+v", index.Collation)
+			}
+			return
+		}
+	}
+	t.Errorf("Expected the rule index to be created; got %v", indexes)
+}
+
+func TestClearPolicy(t *testing.T) {
+	initPolicy(t)
+
+	a := NewAdapter(getDbURL()).(*adapter)
+	for i := 0; i < 2; i++ {
+		if err := a.ClearPolicy(context.Background()); err != nil {
+			t.Fatalf("Expected ClearPolicy() to be successful; got %v", err)
+		}
+	}
+	if n, err := a.Count(context.Background()); err != nil || n != 0 {
+		t.Errorf("Expected no rule to remain; got %d, %v", n, err)
+	}
+
+	if err := a.dropTable(); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.ClearPolicy(context.Background()); err != nil {
+		t.Errorf("Expected ClearPolicy() of a missing collection to be successful; got %v", err)
+	}
+}
+
+func TestRemoveFilteredPolicyCount(t *testing.T) {
+	initPolicy(t)
+
+	a := NewAdapter(getDbURL()).(*adapter)
+	for _, expected := range []int64{2, 0} {
+		n, err := a.RemoveFilteredPolicyCount(context.Background(), "p", "p", 0, "data2_admin")
+		if err != nil || n != expected {
+			t.Errorf("Expected RemoveFilteredPolicyCount() to remove %d rules; got %d, %v", expected, n, err)
+		}
+	}
+}
+
+func TestLongRulesAreNotTruncated(t *testing.T) {
+	initPolicy(t)
+
+	long := []string{"carol", "data1", "read", "a3", "a4", "a5", "a6"}
+	a := NewAdapter(getDbURL()).(*adapter)
+	if err := a.AddPolicies("p", "p", [][]string{long}); err != nil {
+		t.Fatalf("Expected AddPolicies() to be successful; got %v", err)
+	}
+
+	e := casbin.NewEnforcer("examples/rbac_model.conf", a)
+	if err := a.SavePolicy(e.GetModel()); err != nil {
+		t.Fatalf("Expected SavePolicy() to be successful; got %v", err)
+	}
+	e.ClearPolicy()
+	if err := a.LoadPolicy(e.GetModel()); err != nil {
+		t.Fatalf("Expected LoadPolicy() to be successful; got %v", err)
+	}
+	testGetPolicy(t, e, [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}, long})
+
+	// The unique index cannot tell rules apart by their seventh value.
+	d := NewAdapter(getDbURL(), WithIgnoreDuplicates()).(*adapter)
+	other := append(long[:6:6], "b6")
+	if err := d.AddPolicy("p", "p", other); err == nil {
+		t.Errorf("Expected AddPolicy() of a long rule to fail with WithIgnoreDuplicates")
+	}
+}
+
+func TestPool(t *testing.T) {
+	info := &mgo.DialInfo{PoolLimit: 10}
+	PoolOptions{MinSize: 2, MaxIdleTime: time.Minute}.apply(info)
+	if info.PoolLimit != 10 || info.MinPoolSize != 2 || info.MaxIdleTimeMS != 60000 || info.PoolTimeout != 0 {
+		t.Errorf("Expected only the set options to apply; got %+v", info)
+	}
+
+	a := NewAdapter(getDbURL(), WithPool(PoolOptions{MaxSize: 1, Timeout: 5 * time.Second})).(*adapter)
+	e := casbin.NewEnforcer("examples/rbac_model.conf", a)
+	if err := e.LoadPolicy(); err != nil {
+		t.Errorf("Expected LoadPolicy() to be successful; got %v", err)
+	}
+}
+
+func TestPing(t *testing.T) {
+	a := NewAdapter(getDbURL()).(*adapter)
+	if err := a.Ping(context.Background()); err != nil {
+		t.Errorf("Expected Ping() to be successful; got %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := a.Ping(ctx); err != context.Canceled {
+		t.Errorf("Expected Ping() to honor the cancelled context; got %v", err)
+	}
+}
+
+func TestDefaultNames(t *testing.T) {
+	for url, name := range map[string]string{
+		getDbURL():                   "casbin",
+		getDbURL() + "/casbin_myapp": "casbin_myapp",
+	} {
+		a := NewAdapter(url).(*adapter)
+		if a.collection.Database.Name != name || a.collection.Name != "casbin_rule" {
+			t.Errorf("Expected %s to store the rules in %s.casbin_rule; got %s", url, name, a.collection.FullName)
+		}
+	}
+}
+
+func TestRemoveFilteredPolicyByFields(t *testing.T) {
+	initPolicy(t)
+
+	expected := bson.M{"ptype": "p", "v2": "read", "vextra.1": "x"}
+	if selector := BuildFieldsSelector("p", map[int]string{-1: "ignored", 2: "read", 7: "x"}); !reflect.DeepEqual(selector, expected) {
+		t.Errorf("Expected selector %v; got %v", expected, selector)
+	}
+
+	a := NewAdapter(getDbURL()).(*adapter)
+	if err := a.RemoveFilteredPolicyByFields("p", map[int]string{2: "read"}); err != nil {
+		t.Fatalf("Expected RemoveFilteredPolicyByFields() to be successful; got %v", err)
+	}
+
+	e := casbin.NewEnforcer("examples/rbac_model.conf", a)
+	testGetPolicy(t, e, [][]string{{"bob", "data2", "write"}, {"data2_admin", "data2", "write"}})
+}
+
+func TestFieldNames(t *testing.T) {
+	a := NewAdapter(getDbURL(), WithCollectionName("casbin_rule_named"), WithFieldNames("type", "subject", "object", "action")).(*adapter)
+	if err := a.dropTable(); err != nil {
+		t.Fatal(err)
+	}
+	defer a.dropTable()
+
+	// Written by another system.
+	for _, doc := range []bson.M{
+		{"type": "p", "subject": "alice", "object": "data1", "action": "read"},
+		{"type": "p", "subject": "bob", "object": "data2", "action": "write"},
+		{"type": "g", "subject": "alice", "object": "admin"},
+	} {
+		if err := a.collection.Insert(doc); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	e := casbin.NewEnforcer("examples/rbac_model.conf", a)
+	testGetPolicy(t, e, [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}})
+
+	if err := a.AddPolicy("p", "p", []string{"carol", "data1", "read"}); err != nil {
+		t.Fatalf("Expected AddPolicy() to be successful; got %v", err)
+	}
+	if n, err := a.collection.Find(bson.M{"subject": "carol", "action": "read"}).Count(); err != nil || n != 1 {
+		t.Errorf("Expected the rule to be stored under the named fields; got %d, %v", n, err)
+	}
+	if err := a.AddPolicy("p", "p", []string{"carol", "data1", "read", "extra"}); err == nil {
+		t.Error("Expected AddPolicy() of a rule longer than the named fields to fail")
+	}
+
+	if err := a.RemoveFilteredPolicy("p", "p", 1, "data1"); err != nil {
+		t.Fatalf("Expected RemoveFilteredPolicy() to be successful; got %v", err)
+	}
+	if err := a.RemovePolicy("p", "p", []string{"bob", "data2"}); err != nil {
+		t.Fatalf("Expected RemovePolicy() to be successful; got %v", err)
+	}
+	if roles, err := a.RolesForUser("alice", ""); err != nil || !reflect.DeepEqual(roles, []string{"admin"}) {
+		t.Errorf("Expected alice to have the admin role; got %v, %v", roles, err)
+	}
+
+	if err := e.LoadPolicy(); err != nil {
+		t.Fatalf("Expected LoadPolicy() to be successful; got %v", err)
+	}
+	testGetPolicy(t, e, [][]string{{"bob", "data2", "write"}})
+
+	problems, err := a.CheckIndexes(context.Background())
+	if err != nil || len(problems) != 0 {
+		t.Errorf("Expected the rule index on the named fields; got %v, %v", problems, err)
+	}
+}
+
+func TestMigrateFieldNames(t *testing.T) {
+	initPolicy(t)
+
+	a := NewAdapter(getDbURL()).(*adapter)
+	legacy := bson.M{"PType": "p", "V0": "carol", "V1": "data1", "V2": "read", "V3": "", "V4": "", "V5": ""}
+	if err := a.collection.Insert(legacy); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := a.MigrateFieldNames(context.Background()); err != nil {
+			t.Fatalf("Expected MigrateFieldNames() to be successful; got %v", err)
+		}
+	}
+
+	e := casbin.NewEnforcer("examples/rbac_model.conf", a)
+	testGetPolicy(t, e, [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}, {"carol", "data1", "read"}})
+	if n, err := a.collection.Find(bson.M{"PType": bson.M{"$exists": true}}).Count(); err != nil || n != 0 {
+		t.Errorf("Expected no capitalized field to remain; got %d, %v", n, err)
+	}
+}
+
+// countingMetrics counts the observations it receives by operation.
+type countingMetrics struct {
+	mu        sync.Mutex
+	durations map[string]int
+	errors    map[string]int
+}
+
+func (m *countingMetrics) ObserveDuration(op string, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.durations[op]++
+}
+
+func (m *countingMetrics) IncError(op string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.errors[op]++
+}
+
+func TestMetrics(t *testing.T) {
+	initPolicy(t)
+
+	m := &countingMetrics{durations: map[string]int{}, errors: map[string]int{}}
+	a := NewAdapter(getDbURL(), WithMetrics(m)).(*adapter)
+	e := casbin.NewEnforcer("examples/rbac_model.conf", a)
+	if err := a.AddPolicy("p", "p", []string{"carol", "data1", "read"}); err != nil {
+		t.Fatalf("Expected AddPolicy() to be successful; got %v", err)
+	}
+	if err := a.LoadFilteredPolicy(e.GetModel(), 42); err == nil {
+		t.Fatal("Expected LoadFilteredPolicy() with an invalid filter to fail")
+	}
+
+	expected := map[string]int{"LoadPolicy": 1, "AddPolicy": 1, "LoadFilteredPolicy": 1}
+	if !reflect.DeepEqual(m.durations, expected) {
+		t.Errorf("Expected durations %v; got %v", expected, m.durations)
+	}
+	if expected := map[string]int{"LoadFilteredPolicy": 1}; !reflect.DeepEqual(m.errors, expected) {
+		t.Errorf("Expected errors %v; got %v", expected, m.errors)
+	}
+}
+
+func TestUpdateFilteredPolicies(t *testing.T) {
+	initPolicy(t)
+
+	a := NewAdapter(getDbURL(), WithIgnoreDuplicates()).(*adapter)
+	newRules := [][]string{{"data2_admin", "data2", "read"}, {"data2_admin", "data3", "read"}}
+	oldRules, err := a.UpdateFilteredPolicies("p", "p", newRules, 0, "data2_admin")
+	if err != nil {
+		t.Fatalf("Expected UpdateFilteredPolicies() to be successful; got %v", err)
+	}
+	if !util.Array2DEquals(oldRules, [][]string{{"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}}) {
+		t.Errorf("Expected the data2_admin rules to be returned; got %v", oldRules)
+	}
+
+	e := casbin.NewEnforcer("examples/rbac_model.conf", a)
+	testGetPolicy(t, e, [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data3", "read"}})
+}
+
+func TestSavePolicyToMissingCollection(t *testing.T) {
+	a := NewAdapter(getDbURL(), WithCollectionName("casbin_rule_fresh")).(*adapter)
+	defer a.dropTable()
+	for i := 0; i < 2; i++ {
+		if err := a.dropTable(); err != nil {
+			t.Fatalf("Expected dropping a missing collection to be successful; got %v", err)
+		}
+	}
+
+	e := casbin.NewEnforcer("examples/rbac_model.conf", "examples/rbac_policy.csv")
+	if err := a.SavePolicy(e.GetModel()); err != nil {
+		t.Fatalf("Expected SavePolicy() to a missing collection to be successful; got %v", err)
+	}
+	if n, err := a.Count(context.Background()); err != nil || n != 5 {
+		t.Errorf("Expected the 5 rules to be saved; got %d, %v", n, err)
+	}
+
+	if !isNamespaceNotFound(&mgo.QueryError{Code: 26, Message: "ns does not exist"}) {
+		t.Error("Expected code 26 to mean a missing collection")
+	}
+}
+
+func TestDiffPolicy(t *testing.T) {
+	initPolicy(t)
+
+	a := NewAdapter(getDbURL()).(*adapter)
+	e := casbin.NewEnforcer("examples/rbac_model.conf", "examples/rbac_policy.csv")
+	m := e.GetModel()
+	m["p"]["p"].Policy = append(m["p"]["p"].Policy[:1:1], m["p"]["p"].Policy[2:]...)
+	m["p"]["p"].Policy = append(m["p"]["p"].Policy, []string{"carol", "data1", "read"})
+
+	added, removed, err := a.DiffPolicy(context.Background(), m)
+	if err != nil {
+		t.Fatalf("Expected DiffPolicy() to be successful; got %v", err)
+	}
+	if len(added) != 1 || !reflect.DeepEqual(policyTokens(added[0]), []string{"carol", "data1", "read"}) {
+		t.Errorf("got added %v, want carol's rule", added)
+	}
+	if len(removed) != 1 || !reflect.DeepEqual(policyTokens(removed[0]), []string{"bob", "data2", "write"}) {
+		t.Errorf("got removed %v, want bob's rule", removed)
+	}
+	if n, err := a.Count(context.Background()); err != nil || n != 5 {
+		t.Errorf("Expected DiffPolicy() to leave the 5 stored rules; got %d, %v", n, err)
+	}
+}
+
+func TestLoadPolicyFromCollections(t *testing.T) {
+	admins := []string{"admin1", "admin2"}
+	for i, tenant := range []string{"casbin_rule_tenant1", "casbin_rule_tenant2"} {
+		a := NewAdapter(getDbURL(), WithCollectionName(tenant)).(*adapter)
+		if err := a.dropTable(); err != nil {
+			t.Fatal(err)
+		}
+		if err := a.AddPolicy("p", "p", []string{admins[i], "data1", "read"}); err != nil {
+			t.Fatal(err)
+		}
+		defer a.dropTable()
+	}
+
+	a := NewAdapter(getDbURL()).(*adapter)
+	e := casbin.NewEnforcer("examples/rbac_model.conf", "examples/rbac_policy.csv")
+	e.ClearPolicy()
+	if err := a.LoadPolicyFromCollections(e.GetModel(), "casbin_rule_tenant1", "casbin_rule_tenant2"); err != nil {
+		t.Fatalf("Expected LoadPolicyFromCollections() to be successful; got %v", err)
+	}
+	testGetPolicy(t, e, [][]string{{"admin1", "data1", "read"}, {"admin2", "data1", "read"}})
+}
+
+func TestCaseInsensitive(t *testing.T) {
+	// The indexes get a collation, so the rules are kept apart from those of
+	// the other tests, whose indexes have none.
+	a := NewAdapter(getDbURL(), WithCollectionName("casbin_rule_ci"), WithCaseInsensitive()).(*adapter)
+	defer a.dropTable()
+	e := casbin.NewEnforcer("examples/rbac_model.conf", "examples/rbac_policy.csv")
+	if err := a.SavePolicy(e.GetModel()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := a.RemovePolicy("p", "p", []string{"ALICE", "data1", "READ"}); err != nil {
+		t.Fatalf("Expected RemovePolicy() to be successful; got %v", err)
+	}
+	n, err := a.RemoveFilteredPolicyCount(context.Background(), "p", "p", 0, "Bob")
+	if err != nil || n != 1 {
+		t.Errorf("Expected RemoveFilteredPolicyCount() to remove bob's rule; got %d, %v", n, err)
+	}
+
+	e.ClearPolicy()
+	if err := a.LoadFilteredPolicy(e.GetModel(), Filter{PType: []string{"p"}, V0: []string{"DATA2_ADMIN"}}); err != nil {
+		t.Fatalf("Expected LoadFilteredPolicy() to be successful; got %v", err)
+	}
+	testGetPolicy(t, e, [][]string{{"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}})
+
+	initPolicy(t)
+	a = NewAdapter(getDbURL()).(*adapter)
+	if err := a.RemovePolicy("p", "p", []string{"DATA2_ADMIN", "data2", "read"}); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := a.Count(context.Background()); err != nil || n != 5 {
+		t.Errorf("Expected matching to stay case-sensitive by default; got %d rules, %v", n, err)
+	}
+}
+
+func TestCaseInsensitiveBatches(t *testing.T) {
+	a := NewAdapter(getDbURL(), WithCollectionName("casbin_rule_ci"), WithCaseInsensitive()).(*adapter)
+	defer a.dropTable()
+	e := casbin.NewEnforcer("examples/rbac_model.conf", "examples/rbac_policy.csv")
+	if err := a.SavePolicy(e.GetModel()); err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := a.RemovePoliciesCount("p", "p", [][]string{{"ALICE", "data1", "READ"}, {"Bob", "DATA2", "write"}})
+	if err != nil || n != 2 {
+		t.Errorf("Expected RemovePoliciesCount() to remove both rules; got %d, %v", n, err)
+	}
+	if err := a.UpdatePolicy("p", "p", []string{"DATA2_ADMIN", "data2", "read"}, []string{"data2_admin", "data2", "list"}); err != nil {
+		t.Errorf("Expected UpdatePolicy() to be successful; got %v", err)
+	}
+	if err := a.UpdatePolicies("p", "p", [][]string{{"data2_admin", "DATA2", "WRITE"}}, [][]string{{"data2_admin", "data2", "delete"}}); err != nil {
+		t.Errorf("Expected UpdatePolicies() to be successful; got %v", err)
+	}
+	if added, err := a.AddPolicyIfNotExists("p", "p", []string{"Data2_Admin", "data2", "LIST"}); err != nil || added {
+		t.Errorf("Expected AddPolicyIfNotExists() to find the rule; got %v, %v", added, err)
+	}
+	if n, err := a.TagFiltered("p", "p", 0, []string{"DATA2_ADMIN"}, bson.M{"reviewed": true}); err != nil || n != 2 {
+		t.Errorf("Expected TagFiltered() to match data2_admin's rules; got %d, %v", n, err)
+	}
+	old, err := a.UpdateFilteredPolicies("p", "p", [][]string{{"data2_admin", "data2", "list"}}, 0, "DATA2_ADMIN")
+	if err != nil || len(old) != 2 {
+		t.Errorf("Expected UpdateFilteredPolicies() to match data2_admin's rules; got %v, %v", old, err)
+	}
+
+	e.ClearPolicy()
+	if err := a.LoadPolicy(e.GetModel()); err != nil {
+		t.Fatalf("Expected LoadPolicy() to be successful; got %v", err)
+	}
+	testGetPolicy(t, e, [][]string{{"data2_admin", "data2", "list"}})
+}
+
+func TestLoadPolicyIntoModelMissingSection(t *testing.T) {
+	initPolicy(t)
+
+	a := NewAdapter(getDbURL()).(*adapter)
+	e := casbin.NewEnforcer("examples/rbac_model.conf", "examples/rbac_policy.csv")
+	m := e.GetModel()
+	delete(m, "g")
+	e.ClearPolicy()
+
+	err := a.LoadPolicy(m)
+	uerr, ok := err.(*UnknownPolicyTypesError)
+	if !ok || !reflect.DeepEqual(uerr.PTypes, []string{"g"}) {
+		t.Fatalf("Expected LoadPolicy() to fail with an UnknownPolicyTypesError for g; got %v", err)
+	}
+	if len(m["p"]["p"].Policy) != 0 {
+		t.Errorf("Expected the model to be left as it was; got %v", m["p"]["p"].Policy)
+	}
+
+	m["p"]["p2"] = nil
+	if err := a.SavePolicy(m); err != nil {
+		t.Errorf("Expected SavePolicy() to be successful; got %v", err)
+	}
+}
+
+func TestLoadPolicyInBatches(t *testing.T) {
+	a := NewAdapter(getDbURL(), WithCollectionName("casbin_rule_large"), WithLoadBatchSize(500)).(*adapter)
+	defer a.dropTable()
+	if err := a.dropTable(); err != nil {
+		t.Fatal(err)
+	}
+
+	const n = 50000
+	docs := make([]interface{}, 0, 1000)
+	for i := 0; i < n; i++ {
+		docs = append(docs, CasbinRule{PType: "p", V0: "user" + strconv.Itoa(i), V1: "data1", V2: "read"})
+		if len(docs) == cap(docs) {
+			if err := a.collection.Insert(docs...); err != nil {
+				t.Fatal(err)
+			}
+			docs = docs[:0]
+		}
+	}
+
+	e := casbin.NewEnforcer("examples/rbac_model.conf", "examples/rbac_policy.csv")
+	e.ClearPolicy()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if err := a.LoadPolicyCtx(ctx, e.GetModel()); err != nil {
+		t.Fatalf("Expected LoadPolicyCtx() to be successful; got %v", err)
+	}
+	if got := len(e.GetPolicy()); got != n {
+		t.Errorf("Expected %d rules to be loaded; got %d", n, got)
+	}
+}
+
+func TestAddPolicyIfNotExists(t *testing.T) {
+	initPolicy(t)
+
+	a := NewAdapter(getDbURL()).(*adapter)
+	for _, want := range []bool{true, false} {
+		added, err := a.AddPolicyIfNotExists("p", "p", []string{"carol", "data1", "read"})
+		if err != nil {
+			t.Fatalf("Expected AddPolicyIfNotExists() to be successful; got %v", err)
+		}
+		if added != want {
+			t.Errorf("Expected AddPolicyIfNotExists() to report added=%t; got %t", want, added)
+		}
+	}
+
+	added, err := a.AddPolicyIfNotExists("p", "p", []string{"alice", "data1", "read"})
+	if err != nil || added {
+		t.Errorf("Expected AddPolicyIfNotExists() to leave alice's stored rule alone; got %t, %v", added, err)
+	}
+	if n, err := a.PolicyCount("p", []string{"carol", "data1", "read"}); err != nil || n != 1 {
+		t.Errorf("Expected carol's rule to be stored once; got %d, %v", n, err)
+	}
+}
+
+func TestCopyToWritesThroughDestination(t *testing.T) {
+	initPolicy(t)
+
+	src := NewAdapter(getDbURL()).(*adapter)
+	dst := NewAdapter(getDbURL(), WithCollectionName("casbin_rule_copy_checksum"), WithChecksum([]byte("key"))).(*adapter)
+	if err := dst.dropTable(); err != nil {
+		t.Fatal(err)
+	}
+	defer dst.dropTable()
+	if err := src.CopyTo(dst, nil); err != nil {
+		t.Fatalf("Expected CopyTo() to be successful; got %v", err)
+	}
+
+	var srcIDs []bson.M
+	if err := src.collection.Find(nil).Select(bson.M{"_id": 1}).All(&srcIDs); err != nil {
+		t.Fatal(err)
+	}
+	for _, doc := range srcIDs {
+		if n, err := dst.collection.FindId(doc["_id"]).Count(); err != nil || n != 0 {
+			t.Errorf("Expected the copy to get new ids; got %d copies of %v, %v", n, doc["_id"], err)
+		}
+	}
+	if n, err := dst.collection.Find(bson.M{checksumField: bson.M{"$exists": true}}).Count(); err != nil || n != 5 {
+		t.Errorf("Expected the 5 copied rules to have a checksum; got %d, %v", n, err)
+	}
+
+	if err := src.CopyTo(nil, nil); err == nil {
+		t.Error("Expected CopyTo() to reject a destination which is not a MongoDB adapter")
+	}
+}
+
+func TestUpsertShorterRule(t *testing.T) {
+	initPolicy(t)
+
+	a := NewAdapter(getDbURL(), WithUpsertKey(0, 1)).(*adapter)
+	if err := a.AddPolicy("p", "p", []string{"carol", "data1", "read", "a", "b", "c", "d", "e"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.AddPolicy("p", "p", []string{"carol", "data1", "write"}); err != nil {
+		t.Fatalf("Expected AddPolicy() to be successful; got %v", err)
+	}
+	if err := a.AddPolicyWithTTL("p", "p", []string{"dave", "data1", "read"}, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.AddPolicy("p", "p", []string{"dave", "data1", "write"}); err != nil {
+		t.Fatalf("Expected AddPolicy() to be successful; got %v", err)
+	}
+
+	var docs []bson.M
+	if err := a.collection.Find(bson.M{"v0": bson.M{"$in": []string{"carol", "dave"}}}).All(&docs); err != nil {
+		t.Fatal(err)
+	}
+	if len(docs) != 2 {
+		t.Fatalf("Expected one rule per upsert key; got %v", docs)
+	}
+	for _, doc := range docs {
+		if doc["v2"] != "write" || doc["v3"] != "" {
+			t.Errorf("Expected the shorter rule to replace the values; got %v", doc)
+		}
+		if _, ok := doc["vextra"]; ok {
+			t.Errorf("Expected the values beyond v5 to be unset; got %v", doc)
+		}
+		if _, ok := doc[expireAtField]; ok {
+			t.Errorf("Expected the expiry time to be unset; got %v", doc)
+		}
+	}
+}
+
+func TestConstructorsReturnErrors(t *testing.T) {
+	info := &mgo.DialInfo{Addrs: []string{"fakeserver:27017"}, Timeout: time.Second, FailFast: true}
+	if _, err := NewAdapterWithDialInfoAndError(info); !errors.Is(err, ErrUnreachable) && !errors.Is(err, ErrTimeout) {
+		t.Errorf("Expected NewAdapterWithDialInfoAndError() to fail with ErrUnreachable or ErrTimeout; got %v", err)
+	}
+
+	session, err := mgo.Dial(getDbURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	if _, err := NewAdapterWithDBAndError(session.DB("casbin"), WithCollectionName("casbin$rule")); err == nil {
+		t.Error("Expected NewAdapterWithDBAndError() to fail on an invalid collection name")
+	}
+}
+
+func TestBatchCounts(t *testing.T) {
+	initPolicy(t)
+
+	a := NewAdapter(getDbURL(), WithIgnoreDuplicates()).(*adapter)
+	rules := [][]string{{"alice", "data1", "read"}, {"carol", "data2", "read"}, {"carol", "data1", "read"}}
+	if n, err := a.AddPoliciesCount("p", "p", rules); err != nil || n != 2 {
+		t.Errorf("Expected AddPoliciesCount() to add 2 rules; got %d, %v", n, err)
+	}
+
+	removed := [][]string{{"nobody", "data1", "read"}, {"carol", "data2", "read"}, {"carol", "data1", "read"}}
+	if n, err := a.RemovePoliciesCount("p", "p", removed); err != nil || n != 2 {
+		t.Errorf("Expected RemovePoliciesCount() to remove 2 rules; got %d, %v", n, err)
+	}
+}
+
+func TestTagFilteredFlushesBufferedRules(t *testing.T) {
+	initPolicy(t)
+
+	a := NewAdapter(getDbURL(), WithWriteCoalescing(time.Hour, 0)).(*adapter)
+	defer a.Close()
+	if err := a.AddPolicy("p", "p", []string{"carol", "data2", "read"}); err != nil {
+		t.Fatal(err)
+	}
+	n, err := a.TagFiltered("p", "p", 0, []string{"carol"}, bson.M{"reviewedBy": "dave"})
+	if err != nil || n != 1 {
+		t.Errorf("Expected TagFiltered() to tag the buffered rule; got %d, %v", n, err)
+	}
+}
+
+// skipUnlessReplicaSet skips the test unless a is connected to a replica set
+// or a sharded cluster, which change streams require.
+func skipUnlessReplicaSet(t *testing.T, a *adapter) {
+	var result struct {
+		SetName string `bson:"setName"`
+		Msg     string `bson:"msg"`
+	}
+	if err := a.session.Run("ismaster", &result); err != nil {
+		t.Fatal(err)
+	}
+	if result.SetName == "" && result.Msg != "isdbgrid" {
+		t.Skip("change streams require a replica set")
+	}
+}
+
+// waitCalls returns the number of values received from calls until none is
+// received for wait.
+func waitCalls(calls <-chan struct{}, wait time.Duration) int {
+	n := 0
+	for {
+		select {
+		case <-calls:
+			n++
+		case <-time.After(wait):
+			return n
+		}
+	}
+}
+
+func TestStartWatchDrop(t *testing.T) {
+	initPolicy(t)
+
+	a := NewAdapter(getDbURL()).(*adapter)
+	defer a.Close()
+	skipUnlessReplicaSet(t, a)
+
+	calls := make(chan struct{}, 10)
+	if err := a.StartWatch(context.Background(), func() { calls <- struct{}{} }); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Second)
+
+	if err := a.dropTable(); err != nil {
+		t.Fatal(err)
+	}
+	if n := waitCalls(calls, 2*time.Second); n != 1 {
+		t.Errorf("Expected a single call for the drop; got %d", n)
+	}
+
+	// The call comes once the new stream is open, so a rule added right
+	// after the reload is not missed.
+	if err := a.AddPolicy("p", "p", []string{"alice", "data3", "read"}); err != nil {
+		t.Fatal(err)
+	}
+	if n := waitCalls(calls, 2*time.Second); n != 1 {
+		t.Errorf("Expected a call for the rule added after the drop; got %d", n)
+	}
+}
+
+func TestWatchSubject(t *testing.T) {
+	initPolicy(t)
+
+	a := NewAdapter(getDbURL()).(*adapter)
+	skipUnlessReplicaSet(t, a)
+
+	calls := make(chan struct{}, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- a.WatchSubject(ctx, "p", "alice", func() { calls <- struct{}{} })
+	}()
+	// Let the change stream open.
+	time.Sleep(time.Second)
+
+	if err := a.AddPolicy("p", "p", []string{"bob", "data1", "read"}); err != nil {
+		t.Fatal(err)
+	}
+	if n := waitCalls(calls, time.Second); n != 0 {
+		t.Errorf("Expected no call for another subject; got %d", n)
+	}
+	if err := a.RemovePolicy("p", "p", []string{"alice", "data1", "read"}); err != nil {
+		t.Fatal(err)
+	}
+	if n := waitCalls(calls, time.Second); n != 1 {
+		t.Errorf("Expected a call for the removal of alice's rule; got %d", n)
+	}
+
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Errorf("Expected WatchSubject() to stop with the context; got %v", err)
+	}
+}
+
+func TestAddRulesWithFieldNames(t *testing.T) {
+	var changes []PolicyChange
+	a := NewAdapter(getDbURL(), WithCollectionName("casbin_rule_named"), WithFieldNames("type", "subject", "object", "action"), WithChangeHook(func(change PolicyChange) {
+		changes = append(changes, change)
+	})).(*adapter)
+	if err := a.dropTable(); err != nil {
+		t.Fatal(err)
+	}
+	defer a.dropTable()
+
+	id := bson.NewObjectId()
+	err := a.AddRules([]CasbinRule{
+		{ID: id, PType: "p", V0: "alice", V1: "data1", V2: "read"},
+		{PType: "g", V0: "alice", V1: "admin"},
+	})
+	if err != nil {
+		t.Fatalf("Expected AddRules() to be successful; got %v", err)
+	}
+	if n, err := a.collection.Find(bson.M{"_id": id, "subject": "alice", "action": "read"}).Count(); err != nil || n != 1 {
+		t.Errorf("Expected the rule to be stored under its ID and the named fields; got %d, %v", n, err)
+	}
+	if len(changes) != 2 || changes[0].Op != "AddRules" || changes[1].PType != "g" {
+		t.Errorf("Expected a change per added rule; got %v", changes)
+	}
+
+	e := casbin.NewEnforcer("examples/rbac_model.conf", a)
+	testGetPolicy(t, e, [][]string{{"alice", "data1", "read"}})
+	if roles := e.GetGroupingPolicy(); !util.Array2DEquals(roles, [][]string{{"alice", "admin"}}) {
+		t.Errorf("Expected AddRules() to store alice's admin role; got %v", roles)
+	}
+}
+
+func TestUpgradeToUniqueIndex(t *testing.T) {
+	a := NewAdapter(getDbURL(), WithCollectionName("casbin_rule_upgrade")).(*adapter)
+	defer a.dropTable()
+	if err := a.AddPolicy("p", "p", []string{"alice", "data1", "read"}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, opt := range []Option{WithUniqueIndex(), WithIgnoreDuplicates()} {
+		u, err := NewAdapterWithError(getDbURL(), WithCollectionName("casbin_rule_upgrade"), opt)
+		if err != nil {
+			t.Fatalf("Expected reopening the collection with a unique index to be successful; got %v", err)
+		}
+		if problems, err := u.(*adapter).CheckIndexes(context.Background()); err != nil || len(problems) != 0 {
+			t.Errorf("Expected the unique index to replace the rule index; got %v, %v", problems, err)
+		}
+	}
+}
+
+func TestReadsGoThroughMiddleware(t *testing.T) {
+	initPolicy(t)
+
+	var ops []string
+	a := NewAdapter(getDbURL()).(*adapter)
+	a.Use(func(next OpFunc) OpFunc {
+		return func(op string) error {
+			ops = append(ops, op)
+			return next(op)
+		}
+	})
+
+	if _, err := a.GetPoliciesForSubjects("p", []string{"alice"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.PolicyCount("p", []string{"alice", "data1", "read"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.RolesForUser("alice", ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.UsersForRole("data2_admin", ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.PolicyStats(); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := a.DiffCollections(a); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.RemovePolicyTxOps("p", "p", []string{"alice", "data1", "read"}); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"GetPoliciesForSubjects", "PolicyCount", "RolesForUser", "UsersForRole", "PolicyStats", "DiffCollections", "RemovePolicyTxOps"}
+	if !util.ArrayEquals(ops, expected) {
+		t.Error("Operations: ", ops, ", supposed to be ", expected)
+	}
+}
@@ -0,0 +1,53 @@
+// Copyright 2017 The casbin Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongodbadapter
+
+import (
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+// archiveMatching copies up to limit documents of c matching selector (all of
+// them if limit is 0) into the archive collection and returns the ids of the
+// copied documents, which the caller is expected to remove.
+func (a *adapter) archiveMatching(c *mgo.Collection, selector interface{}, limit int) ([]interface{}, error) {
+	var docs []bson.M
+	if err := a.find(c, selector).Limit(limit).All(&docs); err != nil {
+		return nil, err
+	}
+	if len(docs) == 0 {
+		return nil, nil
+	}
+
+	now := time.Now()
+	ids := make([]interface{}, 0, len(docs))
+	archived := make([]interface{}, 0, len(docs))
+	for _, doc := range docs {
+		id := doc["_id"]
+		doc["_id"] = a.newID()
+		doc["ruleId"] = id
+		doc["deletedAt"] = now
+
+		ids = append(ids, id)
+		archived = append(archived, doc)
+	}
+
+	if err := a.archive.With(c.Database.Session).Insert(archived...); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
@@ -0,0 +1,167 @@
+// Copyright 2017 The casbin Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongodbadapter
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/globalsign/mgo"
+)
+
+// AddRules inserts a batch of fully formed rules, possibly of different
+// policy types, in a single request. The rules are stored like AddPolicy
+// stores them, with the adapter's codec, under their ID or, without one, an
+// ID from the adapter's id factory. Nothing is inserted if any rule lacks a
+// policy type.
+func (a *adapter) AddRules(rules []CasbinRule) error {
+	err := a.runCtx(context.Background(), "AddRules", func(c *mgo.Collection) error {
+		return a.addRules(c, rules)
+	})
+	if err != nil {
+		return err
+	}
+	for _, rule := range rules {
+		a.logChange(nil, PolicyChange{Op: "AddRules", Sec: rule.PType[:1], PType: rule.PType, Rules: [][]string{policyTokens(rule)}})
+	}
+	return nil
+}
+
+func (a *adapter) addRules(c *mgo.Collection, rules []CasbinRule) error {
+	if len(rules) == 0 {
+		return nil
+	}
+
+	docs := make([]interface{}, 0, len(rules))
+	for i, rule := range rules {
+		if rule.PType == "" {
+			return fmt.Errorf("mongodbadapter: rule %d (%v) has no policy type", i, rule)
+		}
+		doc, err := a.encodeWithID(rule.ID, rule.PType[:1], rule.PType, policyTokens(rule))
+		if err != nil {
+			return err
+		}
+		docs = append(docs, doc)
+	}
+
+	_, err := a.insert(c, docs...)
+	return err
+}
+
+// AddPolicies adds several policy rules of the same type to the storage in a
+// single request. The rules are all encoded before anything is written, so
+// that a rule failing to encode is reported, by its position, without any
+// rule being added.
+func (a *adapter) AddPolicies(sec string, ptype string, rules [][]string) error {
+	_, err := a.AddPoliciesCount(sec, ptype, rules)
+	return err
+}
+
+// AddPoliciesCount is like AddPolicies and returns the number of rules added,
+// or changed when configured with WithUpsertKey. Rules skipped as duplicates
+// with WithIgnoreDuplicates are not counted.
+func (a *adapter) AddPoliciesCount(sec string, ptype string, rules [][]string) (int64, error) {
+	var n int64
+	err := a.runCtx(context.Background(), "AddPolicies", func(c *mgo.Collection) error {
+		var err error
+		n, err = a.addPolicies(c, sec, ptype, rules)
+		return err
+	})
+	return n, a.logChange(err, PolicyChange{Op: "AddPolicies", Sec: sec, PType: ptype, Rules: rules})
+}
+
+func (a *adapter) addPolicies(c *mgo.Collection, sec string, ptype string, rules [][]string) (int64, error) {
+	docs := make([]interface{}, 0, len(rules))
+	for i, rule := range rules {
+		doc, err := a.encode(sec, ptype, rule)
+		if err != nil {
+			return 0, fmt.Errorf("mongodbadapter: rule %d (%v): %w", i, rule, err)
+		}
+		docs = append(docs, doc)
+	}
+	if len(docs) == 0 {
+		return 0, nil
+	}
+
+	if len(a.upsertKey) > 0 {
+		var n int64
+		for _, doc := range docs {
+			changed, err := a.upsert(c, doc)
+			if err != nil {
+				return n, err
+			}
+			if changed {
+				n++
+			}
+		}
+		return n, nil
+	}
+	return a.insert(c, docs...)
+}
+
+// RemovePolicies removes several policy rules of the same type from the
+// storage in a single request. Like RemovePolicy, it removes one stored copy
+// of each rule and ignores rules that are not stored.
+func (a *adapter) RemovePolicies(sec string, ptype string, rules [][]string) error {
+	_, err := a.RemovePoliciesCount(sec, ptype, rules)
+	return err
+}
+
+// RemovePoliciesCount is like RemovePolicies and returns the number of rules
+// removed, which leaves out the rules that were not stored.
+func (a *adapter) RemovePoliciesCount(sec string, ptype string, rules [][]string) (int64, error) {
+	var n int64
+	err := a.runCtx(context.Background(), "RemovePolicies", func(c *mgo.Collection) error {
+		var err error
+		n, err = a.removePolicies(c, sec, ptype, rules)
+		return err
+	})
+	return n, a.logChange(err, PolicyChange{Op: "RemovePolicies", Sec: sec, PType: ptype, Rules: rules})
+}
+
+func (a *adapter) removePolicies(c *mgo.Collection, sec string, ptype string, rules [][]string) (int64, error) {
+	if len(rules) == 0 {
+		return 0, nil
+	}
+	// A bulk removal can neither archive the rules nor use a collation, so
+	// the rules are then removed one at a time.
+	if a.archive != nil || a.collation != nil {
+		var n int64
+		for _, rule := range rules {
+			removed, err := a.removePolicy(c, sec, ptype, rule)
+			n += removed
+			if err != nil {
+				return n, err
+			}
+		}
+		return n, nil
+	}
+
+	bulk := c.Bulk()
+	bulk.Unordered()
+	for i, rule := range rules {
+		selector, err := a.selector(sec, ptype, rule)
+		if err != nil {
+			return 0, fmt.Errorf("mongodbadapter: rule %d (%v): %w", i, rule, err)
+		}
+		bulk.Remove(selector)
+	}
+	res, err := bulk.Run()
+	if err != nil {
+		return 0, err
+	}
+	// mgo reports the number of removed documents as matched.
+	return int64(res.Matched), nil
+}
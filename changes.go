@@ -0,0 +1,46 @@
+// Copyright 2017 The casbin Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongodbadapter
+
+// PolicyChange describes a change the adapter made to the stored policy, as
+// reported to the hook set by WithChangeHook.
+type PolicyChange struct {
+	// Op is the name of the method which made the change, e.g.
+	// "AddPolicy" or "RemoveFilteredPolicy".
+	Op    string
+	Sec   string
+	PType string
+	// Rules are the rules added, removed or replaced. They are nil for
+	// SavePolicy and ClearPolicy, which replace the whole policy, and for
+	// RemoveFilteredPolicy and RemoveFilteredPolicyByFields, whose removed
+	// rules are described by FieldIndex and FieldValues, and by Fields.
+	Rules [][]string
+	// NewRules are the rules replacing Rules, for UpdatePolicy,
+	// UpdatePolicies and UpdateFilteredPolicies, whose Rules are the
+	// rules matched by FieldIndex and FieldValues.
+	NewRules    [][]string
+	FieldIndex  int
+	FieldValues []string
+	Fields      map[int]string
+}
+
+// logChange reports change to the adapter's change hook, if any, when the
+// operation making it succeeded, and returns the operation's error.
+func (a *adapter) logChange(err error, change PolicyChange) error {
+	if err == nil && a.changeHook != nil {
+		a.changeHook(change)
+	}
+	return err
+}
@@ -0,0 +1,68 @@
+// Copyright 2017 The casbin Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongodbadapter
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+// checksumField is the document field holding a rule's checksum.
+const checksumField = "checksum"
+
+// ErrInvalidChecksum is returned by LoadPolicy when a stored rule's checksum
+// is missing or does not match its contents.
+var ErrInvalidChecksum = errors.New("mongodbadapter: invalid rule checksum")
+
+// checksum returns the hex encoded HMAC-SHA256 of a rule. Every value is
+// length-prefixed so that no two different rules hash the same input.
+func (a *adapter) checksum(ptype string, rule []string) string {
+	mac := hmac.New(sha256.New, a.checksumKey)
+	var size [8]byte
+	for _, v := range append([]string{ptype}, rule...) {
+		binary.BigEndian.PutUint64(size[:], uint64(len(v)))
+		mac.Write(size[:])
+		mac.Write([]byte(v))
+	}
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// withChecksum returns doc extended with the checksum of the rule it stores.
+func (a *adapter) withChecksum(doc interface{}, ptype string, rule []string) (interface{}, error) {
+	return appendField(doc, checksumField, a.checksum(ptype, rule))
+}
+
+// verifyChecksum checks the checksum stored in raw against the rule decoded
+// from it.
+func (a *adapter) verifyChecksum(raw bson.Raw, ptype string, rule []string) error {
+	var doc struct {
+		Checksum string `bson:"checksum"`
+	}
+	if err := raw.Unmarshal(&doc); err != nil {
+		return err
+	}
+
+	expected := a.checksum(ptype, rule)
+	if !hmac.Equal([]byte(doc.Checksum), []byte(expected)) {
+		return fmt.Errorf("%w: %s rule %v", ErrInvalidChecksum, ptype, rule)
+	}
+	return nil
+}
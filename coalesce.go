@@ -0,0 +1,111 @@
+// Copyright 2017 The casbin Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongodbadapter
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/globalsign/mgo"
+)
+
+// addBuffer collects the rules added by AddPolicy while write coalescing is
+// enabled, until they are flushed in a single insert.
+type addBuffer struct {
+	mu      sync.Mutex
+	window  time.Duration
+	maxSize int
+	docs    []interface{}
+	timer   *time.Timer
+	err     error
+}
+
+// bufferAdd queues doc for insertion, flushing the buffer right away if it is
+// full or arming the flush timer otherwise.
+func (a *adapter) bufferAdd(doc interface{}) error {
+	b := a.addBuffer
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.docs = append(b.docs, doc)
+	if b.maxSize > 0 && len(b.docs) >= b.maxSize {
+		return b.flush(a)
+	}
+
+	if b.timer == nil {
+		b.timer = time.AfterFunc(b.window, func() {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+
+			b.timer = nil
+			if err := b.insert(a); err != nil {
+				b.err = err
+			}
+		})
+	}
+	return nil
+}
+
+// flush inserts the buffered rules and returns the error of the insert, or
+// else the error of the last failed timer-triggered flush. b.mu must be held.
+func (b *addBuffer) flush(a *adapter) error {
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+
+	err := b.insert(a)
+	if err == nil {
+		err = b.err
+	}
+	b.err = nil
+	return err
+}
+
+// insert writes the buffered rules to the collection, as the "Flush"
+// operation. The rules stay buffered if the insert fails, so that the next
+// flush tries them again, unless it failed on a duplicate key: the rules
+// before the duplicate were written and trying again would fail the same way.
+// b.mu must be held.
+func (b *addBuffer) insert(a *adapter) error {
+	if len(b.docs) == 0 {
+		return nil
+	}
+
+	err := a.runCtx(context.Background(), "Flush", func(c *mgo.Collection) error {
+		_, err := a.insert(c, b.docs...)
+		return err
+	})
+	if err == nil || mgo.IsDup(err) {
+		b.docs = nil
+	}
+	return err
+}
+
+// Flush immediately inserts the rules buffered by write coalescing. It
+// returns the error of the insert or, if there was nothing to insert, the
+// error of a timer-triggered flush that failed since the previous call.
+// Without write coalescing it does nothing.
+func (a *adapter) Flush() error {
+	b := a.addBuffer
+	if b == nil {
+		return nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.flush(a)
+}
@@ -0,0 +1,184 @@
+// Copyright 2017 The casbin Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongodbadapter
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+// Codec converts policy rules to and from the documents stored in the
+// collection. The adapter encodes rules with it when saving, adding and
+// removing single rules, and decodes every document it loads with it.
+//
+// Selectors built from field positions (RemoveFilteredPolicy, Filter and
+// GetPoliciesForSubjects) still address the "ptype" and "v0" to "v5" fields,
+// so a custom codec that wants those to keep working has to store them under
+// the same names. WithFieldNames covers the common case of such fields
+// stored under other names.
+type Codec interface {
+	// Encode returns the document storing rule. Unless the codec is
+	// DefaultCodec, the document is also the selector of the rule for
+	// RemovePolicy, UpdatePolicy and the like.
+	Encode(sec string, ptype string, rule []string) (interface{}, error)
+
+	// Decode returns the policy type and the rule stored in a document.
+	Decode(raw bson.Raw) (ptype string, rule []string, err error)
+}
+
+// DefaultCodec is the Codec used unless WithCodec says otherwise. It stores
+// rules as CasbinRule documents, one "v" field per value.
+var DefaultCodec Codec = fieldCodec{}
+
+type fieldCodec struct{}
+
+// Encode returns rule as a CasbinRule.
+func (fieldCodec) Encode(sec string, ptype string, rule []string) (interface{}, error) {
+	return savePolicyLine(ptype, rule), nil
+}
+
+// Decode reads a CasbinRule document.
+func (fieldCodec) Decode(raw bson.Raw) (string, []string, error) {
+	var line CasbinRule
+	if err := raw.Unmarshal(&line); err != nil {
+		return "", nil, err
+	}
+	return line.PType, policyTokens(line), nil
+}
+
+// encode returns the document to insert for rule. CasbinRule documents get
+// their _id from the adapter's id factory; other document types are inserted
+// as the codec built them. The rule's checksum and update time are added when
+// configured.
+func (a *adapter) encode(sec string, ptype string, rule []string) (interface{}, error) {
+	return a.encodeWithID("", sec, ptype, rule)
+}
+
+// encodeWithID is like encode but stores the rule under id, unless it is
+// empty, whatever the type of the document built by the codec.
+func (a *adapter) encodeWithID(id bson.ObjectId, sec string, ptype string, rule []string) (interface{}, error) {
+	if err := a.checkRuleLength(ptype, rule); err != nil {
+		return nil, err
+	}
+	doc, err := a.codec.Encode(sec, ptype, rule)
+	if err != nil {
+		return nil, err
+	}
+
+	if line, ok := doc.(CasbinRule); ok {
+		if id == "" {
+			id = a.newID()
+		}
+		line.ID = id
+		doc = line
+	} else if id != "" {
+		if doc, err = appendField(doc, "_id", id); err != nil {
+			return nil, err
+		}
+	}
+	return a.withMetadata(doc, ptype, rule)
+}
+
+// checkRuleLength rejects the rules longer than six values when configured
+// with WithIgnoreDuplicates: the unique index does not cover the values
+// beyond the sixth one, so such a rule would be silently dropped as a
+// duplicate of a stored rule sharing its first six values.
+func (a *adapter) checkRuleLength(ptype string, rule []string) error {
+	if a.ignoreDuplicates && len(rule) > 6 {
+		return fmt.Errorf("mongodbadapter: %s rule %v has more than six values, which WithIgnoreDuplicates cannot tell apart", ptype, rule)
+	}
+	return nil
+}
+
+// withMetadata returns doc extended with the checksum and the update time of
+// the rule it stores, as configured.
+func (a *adapter) withMetadata(doc interface{}, ptype string, rule []string) (interface{}, error) {
+	var err error
+	if a.checksumKey != nil {
+		if doc, err = a.withChecksum(doc, ptype, rule); err != nil {
+			return nil, err
+		}
+	}
+	if a.timestamps {
+		doc, err = appendField(doc, updatedAtField, time.Now())
+	}
+	return doc, err
+}
+
+// appendField returns doc as a bson.D with the given field appended.
+func appendField(doc interface{}, name string, value interface{}) (bson.D, error) {
+	data, err := bson.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	var fields bson.D
+	if err := bson.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+
+	return append(fields, bson.DocElem{Name: name, Value: value}), nil
+}
+
+// decode returns the policy type and the rule stored in raw, as decoded by
+// the adapter's codec or else by the first fallback codec able to decode it.
+// A codec is deemed unable to decode a document when it returns an error or
+// an empty rule. The error of the adapter's codec is returned when no codec
+// is able to.
+func (a *adapter) decode(raw bson.Raw) (string, []string, error) {
+	ptype, rule, err := a.codec.Decode(raw)
+	if len(a.fallbackCodecs) == 0 || (err == nil && len(rule) > 0) {
+		return ptype, rule, err
+	}
+
+	for _, codec := range a.fallbackCodecs {
+		if p, r, e := codec.Decode(raw); e == nil && len(r) > 0 {
+			return p, r, nil
+		}
+	}
+	return ptype, rule, err
+}
+
+// selector returns the selector matching the documents storing exactly rule.
+// For DefaultCodec, values past the end of the rule must be empty or absent,
+// so that a rule never matches a longer one sharing its prefix nor misses a
+// document written without its empty fields. Other codecs are trusted to
+// encode a suitable selector.
+func (a *adapter) selector(sec string, ptype string, rule []string) (interface{}, error) {
+	if codec, ok := a.codec.(namedFieldCodec); ok {
+		return codec.selector(ptype, rule)
+	}
+	if a.codec != DefaultCodec {
+		return a.codec.Encode(sec, ptype, rule)
+	}
+
+	selector := bson.M{"ptype": ptype}
+	for i := 0; i < 6; i++ {
+		field := "v" + strconv.Itoa(i)
+		if i < len(rule) {
+			selector[field] = rule[i]
+		} else {
+			selector[field] = bson.M{"$in": []interface{}{"", nil}}
+		}
+	}
+	if len(rule) > 6 {
+		selector["vextra"] = rule[6:]
+	} else {
+		selector["vextra"] = bson.M{"$exists": false}
+	}
+	return selector, nil
+}
@@ -0,0 +1,83 @@
+// Copyright 2017 The casbin Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongodbadapter
+
+import (
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+// caseInsensitive is the collation set by WithCaseInsensitive, which compares
+// strings regardless of their case but not of their accents.
+var caseInsensitive = mgo.Collation{Locale: "en", Strength: 2}
+
+// find returns the query for the documents of c matching selector, with the
+// adapter's collation if any.
+func (a *adapter) find(c *mgo.Collection, selector interface{}) *mgo.Query {
+	query := c.Find(selector)
+	if a.collation != nil {
+		query = query.Collation(a.collation)
+	}
+	return query
+}
+
+// matchingIDs returns the ids of at most limit documents of c matching
+// selector with the adapter's collation, or of all of them if limit is 0.
+// mgo cannot remove documents with a collation, so they are found first and
+// then removed by id.
+func (a *adapter) matchingIDs(c *mgo.Collection, selector interface{}, limit int) ([]interface{}, error) {
+	var docs []struct {
+		ID interface{} `bson:"_id"`
+	}
+	if err := a.find(c, selector).Select(bson.M{"_id": 1}).Limit(limit).All(&docs); err != nil {
+		return nil, err
+	}
+
+	ids := make([]interface{}, 0, len(docs))
+	for _, doc := range docs {
+		ids = append(ids, doc.ID)
+	}
+	return ids, nil
+}
+
+// updateOne replaces the first document of c matching selector with update,
+// with the adapter's collation if any, and reports whether one matched. Like
+// for removals, the document is found first and then updated by id when there
+// is a collation.
+func (a *adapter) updateOne(c *mgo.Collection, selector, update interface{}) (bool, error) {
+	var err error
+	if a.collation == nil {
+		err = c.Update(selector, update)
+	} else {
+		var ids []interface{}
+		if ids, err = a.matchingIDs(c, selector, 1); err != nil || len(ids) == 0 {
+			return false, err
+		}
+		err = c.UpdateId(ids[0], update)
+	}
+	if err == mgo.ErrNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// indexCollation returns the collation of the indexes which do not set their
+// own.
+func (a *adapter) indexCollation() *mgo.Collation {
+	if a.indexOptions.Collation != nil {
+		return a.indexOptions.Collation
+	}
+	return a.collation
+}
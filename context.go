@@ -0,0 +1,108 @@
+// Copyright 2017 The casbin Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongodbadapter
+
+import (
+	"context"
+	"time"
+
+	"github.com/globalsign/mgo"
+)
+
+// contextKey is the type of the context keys holding the per-operation
+// overrides of the adapter's defaults.
+type contextKey int
+
+const (
+	readConcernKey contextKey = iota
+	writeConcernKey
+)
+
+// ContextWithReadConcern returns a copy of ctx requesting the given read
+// concern level, e.g. "majority", for the reads done by the adapter's
+// context-aware methods with that ctx. It takes precedence over the read
+// concern of the adapter's session.
+func ContextWithReadConcern(ctx context.Context, level string) context.Context {
+	return context.WithValue(ctx, readConcernKey, level)
+}
+
+// ContextWithWriteConcern returns a copy of ctx requesting the write concern
+// described by safe, e.g. mgo.Safe{WMode: "majority"}, for the writes done by
+// the adapter's context-aware methods with that ctx. Its RMode is ignored in
+// favor of ContextWithReadConcern. It takes precedence over WithWriteConcern
+// and the write concern of the adapter's session.
+func ContextWithWriteConcern(ctx context.Context, safe mgo.Safe) context.Context {
+	return context.WithValue(ctx, writeConcernKey, safe)
+}
+
+// applyConcerns applies the read and write concerns requested by ctx, or else
+// configured with WithWriteConcern, if any, to session. Overriding either one
+// on an unacknowledged session makes it acknowledged.
+func (a *adapter) applyConcerns(ctx context.Context, session *mgo.Session) {
+	level, hasRead := ctx.Value(readConcernKey).(string)
+	write, hasWrite := ctx.Value(writeConcernKey).(mgo.Safe)
+	if !hasWrite && a.writeConcern != nil {
+		write, hasWrite = *a.writeConcern, true
+	}
+	if !hasRead && !hasWrite {
+		return
+	}
+
+	var safe mgo.Safe
+	if current := session.Safe(); current != nil {
+		safe = *current
+	}
+	if hasWrite {
+		write.RMode = safe.RMode
+		safe = write
+	}
+	if hasRead {
+		safe.RMode = level
+	}
+	session.SetSafe(&safe)
+}
+
+// collectionFor returns the adapter's collection bound to a copy of its
+// session for the duration of a single operation, along with a function
+// releasing that session. mgo has no notion of a context, so ctx is honored
+// as far as the driver allows: an already cancelled ctx fails immediately and
+// a ctx deadline bounds every network round trip of the operation. Without a
+// deadline, the timeout set by WithTimeout applies, if any. Read and write
+// concerns requested by ctx apply to the session.
+func (a *adapter) collectionFor(ctx context.Context) (*mgo.Collection, func(), error) {
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+	if err := a.connect(); err != nil {
+		return nil, nil, err
+	}
+
+	session := a.session.Copy()
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout := time.Until(deadline)
+		if timeout <= 0 {
+			session.Close()
+			return nil, nil, context.DeadlineExceeded
+		}
+		session.SetSocketTimeout(timeout)
+		session.SetSyncTimeout(timeout)
+	} else if a.timeout > 0 {
+		session.SetSocketTimeout(a.timeout)
+		session.SetSyncTimeout(a.timeout)
+	}
+	a.applyConcerns(ctx, session)
+
+	return a.collection.With(session), session.Close, nil
+}
@@ -0,0 +1,238 @@
+// Copyright 2017 The casbin Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongodbadapter
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/casbin/casbin/model"
+	"github.com/casbin/casbin/persist"
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+// ruleSort orders rules by their policy type and first six values. MongoDB
+// sorts arrays by their smallest element, so the values beyond the sixth one
+// cannot take part in the order.
+var ruleSort = []string{"ptype", "v0", "v1", "v2", "v3", "v4", "v5"}
+
+// compareRules compares two rules in the order of ruleSort.
+func compareRules(x, y CasbinRule) int {
+	xs := []string{x.PType, x.V0, x.V1, x.V2, x.V3, x.V4, x.V5}
+	ys := []string{y.PType, y.V0, y.V1, y.V2, y.V3, y.V4, y.V5}
+	for i := range xs {
+		if c := strings.Compare(xs[i], ys[i]); c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+// diffExtra compares rules which compareRules deems equal by the values
+// beyond their sixth one, returning those found only in here and only in
+// there.
+func diffExtra(here, there []CasbinRule) (onlyHere, onlyThere []CasbinRule) {
+	key := func(rule CasbinRule) string {
+		return strconv.Itoa(len(rule.VExtra)) + "\x00" + strings.Join(rule.VExtra, "\x00")
+	}
+
+	counts := make(map[string]int)
+	for _, rule := range there {
+		counts[key(rule)]++
+	}
+	for _, rule := range here {
+		if k := key(rule); counts[k] > 0 {
+			counts[k]--
+		} else {
+			onlyHere = append(onlyHere, rule)
+		}
+	}
+	for _, rule := range there {
+		if k := key(rule); counts[k] > 0 {
+			counts[k]--
+			onlyThere = append(onlyThere, rule)
+		}
+	}
+	return onlyHere, onlyThere
+}
+
+// sortedRules iterates over the rules of c in the order of ruleSort.
+type sortedRules struct {
+	iter *mgo.Iter
+	rule CasbinRule
+	ok   bool
+}
+
+func newSortedRules(c *mgo.Collection) *sortedRules {
+	s := &sortedRules{iter: c.Find(nil).Sort(ruleSort...).Iter()}
+	s.next()
+	return s
+}
+
+func (s *sortedRules) next() {
+	s.rule = CasbinRule{}
+	s.ok = s.iter.Next(&s.rule)
+}
+
+// group returns the current rule along with the following ones comparing
+// equal to it, and moves past them.
+func (s *sortedRules) group() []CasbinRule {
+	first := s.rule
+	rules := []CasbinRule{first}
+	for s.next(); s.ok && compareRules(s.rule, first) == 0; s.next() {
+		rules = append(rules, s.rule)
+	}
+	return rules
+}
+
+// DiffCollections compares the rules stored by the adapter with the ones
+// stored by other, which must be an adapter created by this package, e.g. a
+// staging and a production policy, and returns the rules found only here and
+// those found only there. Rules stored several times are compared as many
+// times. Both collections are streamed in rule order, so the comparison only
+// holds rules sharing their first six values in memory, and the rules are
+// returned in that order. Rules are compared by their policy type and values,
+// regardless of their _id, which assumes the default field layout.
+func (a *adapter) DiffCollections(other persist.Adapter) (onlyHere, onlyThere []CasbinRule, err error) {
+	o, ok := other.(*adapter)
+	if !ok {
+		return nil, nil, fmt.Errorf("mongodbadapter: unsupported diff target %T", other)
+	}
+
+	err = a.runCtx(context.Background(), "DiffCollections", func(c *mgo.Collection) error {
+		oc, release, err := o.collectionFor(context.Background())
+		if err != nil {
+			return err
+		}
+		defer release()
+
+		onlyHere, onlyThere, err = diffCollections(c, oc)
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return onlyHere, onlyThere, nil
+}
+
+func diffCollections(hc, tc *mgo.Collection) (onlyHere, onlyThere []CasbinRule, err error) {
+	here := newSortedRules(hc)
+	defer here.iter.Close()
+	there := newSortedRules(tc)
+	defer there.iter.Close()
+
+	for here.ok || there.ok {
+		c := 0
+		switch {
+		case !here.ok:
+			c = 1
+		case !there.ok:
+			c = -1
+		default:
+			c = compareRules(here.rule, there.rule)
+		}
+
+		switch {
+		case c < 0:
+			onlyHere = append(onlyHere, here.rule)
+			here.next()
+		case c > 0:
+			onlyThere = append(onlyThere, there.rule)
+			there.next()
+		default:
+			h, t := diffExtra(here.group(), there.group())
+			onlyHere = append(onlyHere, h...)
+			onlyThere = append(onlyThere, t...)
+		}
+	}
+
+	if err := here.iter.Err(); err != nil {
+		return nil, nil, err
+	}
+	if err := there.iter.Err(); err != nil {
+		return nil, nil, err
+	}
+	return onlyHere, onlyThere, nil
+}
+
+// DiffPolicy returns the rules SavePolicy would add to and remove from the
+// storage to save the model, without writing anything, so that a large
+// policy change can be reviewed before it is saved. Like with SavePolicy,
+// rules the model holds more than once count once, and stored duplicates of a
+// rule beyond the first one are reported as removed. The stored rules are
+// read whole, keyed by rule, into memory.
+func (a *adapter) DiffPolicy(ctx context.Context, model model.Model) (added, removed []CasbinRule, err error) {
+	err = a.runCtx(ctx, "DiffPolicy", func(c *mgo.Collection) error {
+		var err error
+		added, removed, err = a.diffPolicy(c, model)
+		return err
+	})
+	return added, removed, err
+}
+
+func (a *adapter) diffPolicy(c *mgo.Collection, model model.Model) (added, removed []CasbinRule, err error) {
+	stored := make(map[string]int)
+	var keys []string
+	var rules []CasbinRule
+	var raw bson.Raw
+	iter := c.Find(nil).Iter()
+	for iter.Next(&raw) {
+		ptype, rule, err := a.decode(raw)
+		if err != nil {
+			iter.Close()
+			return nil, nil, err
+		}
+		key := ruleKey(ptype, rule)
+		if stored[key] > 0 {
+			removed = append(removed, savePolicyLine(ptype, rule))
+		} else {
+			keys = append(keys, key)
+			rules = append(rules, savePolicyLine(ptype, rule))
+		}
+		stored[key]++
+	}
+	if err := iter.Close(); err != nil {
+		return nil, nil, err
+	}
+
+	seen := make(map[string]struct{})
+	for _, sec := range []string{"p", "g"} {
+		for ptype, ast := range model[sec] {
+			if ast == nil {
+				continue
+			}
+			for _, rule := range ast.Policy {
+				key := ruleKey(ptype, rule)
+				if _, ok := seen[key]; ok {
+					continue
+				}
+				seen[key] = struct{}{}
+				if stored[key] == 0 {
+					added = append(added, savePolicyLine(ptype, rule))
+				}
+			}
+		}
+	}
+
+	for i, rule := range rules {
+		if _, ok := seen[keys[i]]; !ok {
+			removed = append(removed, rule)
+		}
+	}
+	return added, removed, nil
+}
@@ -0,0 +1,126 @@
+// Copyright 2017 The casbin Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongodbadapter
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/globalsign/mgo"
+)
+
+// Classes of failures to connect to MongoDB. Errors returned when opening the
+// adapter match one of them with errors.Is when the failure could be
+// classified, and unwrap to the driver's error.
+var (
+	ErrAuth        = errors.New("mongodbadapter: authentication failed")
+	ErrUnreachable = errors.New("mongodbadapter: server unreachable")
+	ErrTimeout     = errors.New("mongodbadapter: connection timed out")
+)
+
+// UnknownPolicyTypesError is returned by LoadPolicy when stored rules have a
+// policy type the model does not define, e.g. "p2" rules loaded into a model
+// without a "p2" definition or without a "p" section at all, unless the
+// adapter is configured with WithSkipUnknownPolicyTypes.
+type UnknownPolicyTypesError struct {
+	// PTypes are the unknown policy types, sorted.
+	PTypes []string
+}
+
+func (e *UnknownPolicyTypesError) Error() string {
+	names := make([]string, len(e.PTypes))
+	for i, ptype := range e.PTypes {
+		names[i] = strconv.Quote(ptype)
+	}
+	return "mongodbadapter: policy types not defined in the model: " + strings.Join(names, ", ")
+}
+
+// codeAuthenticationFailed is the server error code for bad credentials.
+const codeAuthenticationFailed = 18
+
+// OpenError is a classified failure to connect to MongoDB.
+type OpenError struct {
+	// Kind is ErrAuth, ErrUnreachable or ErrTimeout.
+	Kind error
+	// Err is the error returned by the driver.
+	Err error
+}
+
+func (e *OpenError) Error() string {
+	return e.Kind.Error() + ": " + e.Err.Error()
+}
+
+// Unwrap returns the driver's error.
+func (e *OpenError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether target is the class of the failure.
+func (e *OpenError) Is(target error) bool {
+	return target == e.Kind
+}
+
+// classifyOpenError wraps err, returned by the driver while connecting, in an
+// OpenError if its class can be told. Other errors are returned as they are.
+func classifyOpenError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	var kind error
+	if qerr, ok := err.(*mgo.QueryError); ok && qerr.Code == codeAuthenticationFailed {
+		kind = ErrAuth
+	} else if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+		kind = ErrTimeout
+	} else {
+		msg := err.Error()
+		switch {
+		case strings.Contains(msg, "auth fail") || strings.Contains(msg, "Authentication failed"):
+			kind = ErrAuth
+		case strings.Contains(msg, "timeout") || strings.Contains(msg, "timed out"):
+			kind = ErrTimeout
+		case strings.Contains(msg, "no reachable servers") || strings.Contains(msg, "connection refused"):
+			kind = ErrUnreachable
+		default:
+			return err
+		}
+	}
+
+	return &OpenError{Kind: kind, Err: err}
+}
+
+// isConnectionError reports whether err means the connection the session was
+// using is broken, after which mgo keeps failing until the session is
+// refreshed.
+func isConnectionError(err error) bool {
+	if err == nil {
+		return false
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return true
+	}
+	if _, ok := err.(net.Error); ok {
+		return true
+	}
+
+	msg := err.Error()
+	return strings.Contains(msg, "Closed explicitly") ||
+		strings.Contains(msg, "connection reset") ||
+		strings.Contains(msg, "broken pipe") ||
+		strings.Contains(msg, "no reachable servers")
+}
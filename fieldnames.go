@@ -0,0 +1,140 @@
+// Copyright 2017 The casbin Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongodbadapter
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+// namedFieldCodec stores rules with one field per value, like DefaultCodec,
+// under the names given to WithFieldNames.
+type namedFieldCodec struct {
+	ptype  string
+	values []string
+}
+
+// Encode returns rule as a document with the codec's field names.
+func (c namedFieldCodec) Encode(sec string, ptype string, rule []string) (interface{}, error) {
+	if len(rule) > len(c.values) {
+		return nil, fmt.Errorf("mongodbadapter: %s rule %v has more values than the %d named fields", ptype, rule, len(c.values))
+	}
+
+	doc := bson.D{{Name: c.ptype, Value: ptype}}
+	for i, value := range rule {
+		doc = append(doc, bson.DocElem{Name: c.values[i], Value: value})
+	}
+	return doc, nil
+}
+
+// Decode reads a document with the codec's field names. Missing and
+// non-string values are read as empty, and empty values at the end of the
+// rule are left out.
+func (c namedFieldCodec) Decode(raw bson.Raw) (string, []string, error) {
+	var doc bson.M
+	if err := raw.Unmarshal(&doc); err != nil {
+		return "", nil, err
+	}
+
+	ptype, _ := doc[c.ptype].(string)
+	rule := make([]string, len(c.values))
+	n := 0
+	for i, name := range c.values {
+		rule[i], _ = doc[name].(string)
+		if rule[i] != "" {
+			n = i + 1
+		}
+	}
+	return ptype, rule[:n], nil
+}
+
+// selector returns the selector matching the documents storing exactly rule,
+// whose values past its end must be empty or absent.
+func (c namedFieldCodec) selector(ptype string, rule []string) (bson.M, error) {
+	if len(rule) > len(c.values) {
+		return nil, fmt.Errorf("mongodbadapter: %s rule %v has more values than the %d named fields", ptype, rule, len(c.values))
+	}
+
+	selector := bson.M{c.ptype: ptype}
+	for i, name := range c.values {
+		if i < len(rule) {
+			selector[name] = rule[i]
+		} else {
+			selector[name] = bson.M{"$in": []interface{}{"", nil}}
+		}
+	}
+	return selector, nil
+}
+
+// fieldName returns the name of the field stored as name, e.g. "v0", by the
+// default field layout.
+func (a *adapter) fieldName(name string) string {
+	if renamed, ok := a.fieldNames[name]; ok {
+		return renamed
+	}
+	return name
+}
+
+// renameFields returns selector, written for the default field layout, with
+// its top-level fields renamed as configured with WithFieldNames.
+func (a *adapter) renameFields(selector bson.M) bson.M {
+	if a.fieldNames == nil {
+		return selector
+	}
+
+	renamed := make(bson.M, len(selector))
+	for name, value := range selector {
+		renamed[a.fieldName(name)] = value
+	}
+	return renamed
+}
+
+// renameIndex returns index, written for the default field layout, with its
+// fields renamed as configured with WithFieldNames. Value fields without a
+// name are left out of its key.
+func (a *adapter) renameIndex(index mgo.Index) mgo.Index {
+	if a.fieldNames == nil {
+		return index
+	}
+
+	key := make([]string, 0, len(index.Key))
+	for _, name := range index.Key {
+		if renamed, ok := a.fieldNames[name]; ok {
+			key = append(key, renamed)
+		}
+	}
+	index.Key = key
+	if index.PartialFilter != nil {
+		index.PartialFilter = a.renameFields(index.PartialFilter)
+	}
+	return index
+}
+
+// newNamedFields returns the codec storing rules under the given field names
+// and the mapping from the default field names to them.
+func newNamedFields(ptype string, values []string) (namedFieldCodec, map[string]string) {
+	if len(values) > 6 {
+		values = values[:6]
+	}
+
+	names := map[string]string{"ptype": ptype}
+	for i, name := range values {
+		names["v"+strconv.Itoa(i)] = name
+	}
+	return namedFieldCodec{ptype: ptype, values: values}, names
+}
@@ -0,0 +1,146 @@
+// Copyright 2017 The casbin Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongodbadapter
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/casbin/casbin/model"
+	"github.com/casbin/casbin/persist"
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+var _ persist.FilteredAdapter = (*adapter)(nil)
+
+// Filter selects the rules loaded by LoadFilteredPolicy. Each non-empty
+// field restricts the corresponding rule field to one of the listed values,
+// and each non-empty field of Not excludes the listed values from it.
+//
+// All clauses are combined with AND: a rule is loaded only if it matches
+// every positive clause and none of the negative ones. A field may carry both
+// kinds of clause, e.g. V0 restricting subjects to a tenant's users while
+// Not.V0 leaves out one of them.
+type Filter struct {
+	PType []string
+	V0    []string
+	V1    []string
+	V2    []string
+	V3    []string
+	V4    []string
+	V5    []string
+
+	Not FilterNot
+}
+
+// FilterNot lists the values a Filter excludes from each rule field.
+type FilterNot struct {
+	PType []string
+	V0    []string
+	V1    []string
+	V2    []string
+	V3    []string
+	V4    []string
+	V5    []string
+}
+
+// selector translates the filter into a MongoDB query.
+func (f *Filter) selector() bson.M {
+	selector := bson.M{}
+	fields := []struct {
+		key     string
+		in, nin []string
+	}{
+		{"ptype", f.PType, f.Not.PType},
+		{"v0", f.V0, f.Not.V0},
+		{"v1", f.V1, f.Not.V1},
+		{"v2", f.V2, f.Not.V2},
+		{"v3", f.V3, f.Not.V3},
+		{"v4", f.V4, f.Not.V4},
+		{"v5", f.V5, f.Not.V5},
+	}
+
+	for _, field := range fields {
+		cond := bson.M{}
+		switch len(field.in) {
+		case 0:
+		case 1:
+			cond["$eq"] = field.in[0]
+		default:
+			cond["$in"] = field.in
+		}
+		switch len(field.nin) {
+		case 0:
+		case 1:
+			cond["$ne"] = field.nin[0]
+		default:
+			cond["$nin"] = field.nin
+		}
+
+		if len(cond) > 0 {
+			selector[field.key] = cond
+		}
+	}
+
+	return selector
+}
+
+// LoadFilteredPolicy loads only the policy rules matching the filter, which
+// must be a Filter, a *Filter, or a MongoDB query given as a bson.M or a
+// bson.D, e.g. bson.M{"ptype": "g", "v1": "admin"}. A nil filter loads the
+// whole policy, like LoadPolicy. Once a filtered policy is loaded,
+// IsFiltered reports true, which keeps Casbin from saving the partial policy
+// over the whole one.
+func (a *adapter) LoadFilteredPolicy(model model.Model, filter interface{}) error {
+	ctx := context.Background()
+	return a.runCtx(ctx, "LoadFilteredPolicy", func(c *mgo.Collection) error {
+		return a.loadFilteredPolicy(ctx, c, model, filter)
+	})
+}
+
+func (a *adapter) loadFilteredPolicy(ctx context.Context, c *mgo.Collection, model model.Model, filter interface{}) error {
+	if filter == nil {
+		a.isFiltered = false
+		return a.loadPolicy(ctx, c, model, nil)
+	}
+
+	var selector interface{}
+	switch filter := filter.(type) {
+	case Filter:
+		selector = a.renameFields(filter.selector())
+	case *Filter:
+		if filter == nil {
+			a.isFiltered = false
+			return a.loadPolicy(ctx, c, model, nil)
+		}
+		selector = a.renameFields(filter.selector())
+	case bson.M, bson.D:
+		selector = filter
+	default:
+		return fmt.Errorf("mongodbadapter: unsupported filter type %T", filter)
+	}
+
+	if err := a.loadPolicy(ctx, c, model, selector); err != nil {
+		return err
+	}
+	a.isFiltered = true
+	return nil
+}
+
+// IsFiltered returns true if the loaded policy has been filtered.
+func (a *adapter) IsFiltered() bool {
+	return a.isFiltered
+}
@@ -0,0 +1,132 @@
+// Copyright 2017 The casbin Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongodbadapter
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/globalsign/mgo"
+)
+
+// IndexOptions configure how the adapter builds its indexes, see
+// WithIndexOptions.
+type IndexOptions struct {
+	// Foreground builds the indexes in the foreground on servers older
+	// than MongoDB 4.2, which is faster and yields more compact indexes
+	// but blocks the database during the build. The adapter otherwise
+	// builds them in the background there.
+	Foreground bool
+	// Collation, if not nil, is the collation of the indexes which do not
+	// set their own, e.g. {Locale: "en", Strength: 2} for case-insensitive
+	// comparisons. Queries only use an index with a collation when they
+	// request the same one, which the adapter's queries only do with
+	// WithCaseInsensitive or if it is also the collection's default
+	// collation, see WithCollectionInfo.
+	Collation *mgo.Collation
+}
+
+// indexKey identifies an index by its key, e.g. "ptype,v0".
+func indexKey(index mgo.Index) string {
+	return strings.Join(index.Key, ",")
+}
+
+// legacyIndexKeys are the keys of the single-field indexes created by older
+// versions, which CheckIndexes tolerates.
+var legacyIndexKeys = map[string]bool{
+	"ptype": true, "v0": true, "v1": true, "v2": true, "v3": true, "v4": true, "v5": true,
+}
+
+// CheckIndexes compares the indexes of the collection with the ones the
+// adapter is configured to create and returns a description of every
+// difference: missing indexes, indexes whose uniqueness differs and
+// unexpected extra indexes, not counting the single-field indexes created by
+// older versions. No difference means the indexes are exactly as expected.
+// Unlike the index creation done when opening the adapter, CheckIndexes
+// never modifies the collection.
+func (a *adapter) CheckIndexes(ctx context.Context) ([]string, error) {
+	c, release, err := a.collectionFor(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	actual, err := c.Indexes()
+	if err != nil {
+		return nil, err
+	}
+	found := make(map[string]mgo.Index, len(actual))
+	for _, index := range actual {
+		found[indexKey(index)] = index
+	}
+
+	expected := append([]mgo.Index{{Key: []string{"_id"}}}, a.expectedIndexes()...)
+	var problems []string
+	for _, index := range expected {
+		key := indexKey(index)
+		existing, ok := found[key]
+		if !ok {
+			problems = append(problems, fmt.Sprintf("missing index on (%s)", key))
+			continue
+		}
+		delete(found, key)
+
+		if existing.Unique != index.Unique {
+			problems = append(problems, fmt.Sprintf("index %s on (%s) has unique=%t, expected %t", existing.Name, key, existing.Unique, index.Unique))
+		}
+	}
+
+	for _, index := range actual {
+		key := indexKey(index)
+		if _, ok := found[key]; ok && !legacyIndexKeys[key] {
+			problems = append(problems, fmt.Sprintf("unexpected index %s on (%s)", index.Name, key))
+		}
+	}
+
+	return problems, nil
+}
+
+// EnsureDatabase explicitly creates the collection, and the archive
+// collection if one is configured, along with the adapter's indexes, so that
+// the namespace exists before any policy is written. MongoDB otherwise creates
+// databases and collections lazily on first write. Existing collections and
+// indexes are left as they are, which makes EnsureDatabase safe to call
+// repeatedly, e.g. from provisioning scripts.
+func (a *adapter) EnsureDatabase(ctx context.Context) error {
+	c, release, err := a.collectionFor(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	info := a.collectionInfo
+	if info == nil {
+		info = &mgo.CollectionInfo{}
+	}
+	if err := createCollection(c, info); err != nil {
+		return err
+	}
+	if a.archive != nil {
+		if err := createCollection(a.archive.With(c.Database.Session), &mgo.CollectionInfo{}); err != nil {
+			return err
+		}
+	}
+
+	// mgo remembers which indexes it already ensured and would skip them
+	// even if the collection has been dropped in the meantime.
+	c.Database.Session.ResetIndexCache()
+	return a.ensureIndexes(c)
+}
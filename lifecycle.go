@@ -0,0 +1,137 @@
+// Copyright 2017 The casbin Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongodbadapter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// shutdownTimeout bounds how long closing the adapter waits for its
+// background activities to stop.
+const shutdownTimeout = 10 * time.Second
+
+// errShutdownTimeout is reported when background activities did not stop
+// within shutdownTimeout.
+var errShutdownTimeout = errors.New("mongodbadapter: timed out waiting for background activities to stop")
+
+// lifecycle coordinates the activities running in the background of an
+// adapter, such as watchers, so that closing the adapter stops them all.
+type lifecycle struct {
+	init   sync.Once
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mu   sync.Mutex
+	errs []error
+}
+
+// lifecycle returns the adapter's lifecycle, creating it on first use.
+func (a *adapter) lifecycle() *lifecycle {
+	l := &a.life
+	l.init.Do(func() {
+		l.ctx, l.cancel = context.WithCancel(context.Background())
+	})
+	return l
+}
+
+// track registers an activity running until ctx is done. It returns a
+// context which is also cancelled when the adapter is closed, and a function
+// the activity must call when it ends.
+func (a *adapter) track(ctx context.Context) (context.Context, func()) {
+	l := a.lifecycle()
+	l.wg.Add(1)
+
+	ctx, cancel := context.WithCancel(ctx)
+	stop := make(chan struct{})
+	go func() {
+		select {
+		case <-l.ctx.Done():
+			cancel()
+		case <-stop:
+		}
+	}()
+
+	return ctx, func() {
+		close(stop)
+		cancel()
+		l.wg.Done()
+	}
+}
+
+// goBackground runs fn in a goroutine until it returns, which it must do
+// once the context it is given is done. That context is derived from ctx and
+// also cancelled when the adapter is closed, and closing reports the error fn
+// returns, if any.
+func (a *adapter) goBackground(ctx context.Context, fn func(ctx context.Context) error) {
+	ctx, done := a.track(ctx)
+	go func() {
+		defer done()
+		if err := fn(ctx); err != nil && !errors.Is(err, context.Canceled) {
+			l := a.lifecycle()
+			l.mu.Lock()
+			l.errs = append(l.errs, err)
+			l.mu.Unlock()
+		}
+	}()
+}
+
+// shutdown stops the adapter's background activities and waits for them,
+// at most shutdownTimeout, returning the errors they reported.
+func (a *adapter) shutdown() []error {
+	l := a.lifecycle()
+	l.cancel()
+
+	stopped := make(chan struct{})
+	go func() {
+		l.wg.Wait()
+		close(stopped)
+	}()
+
+	var errs []error
+	select {
+	case <-stopped:
+	case <-time.After(shutdownTimeout):
+		errs = append(errs, errShutdownTimeout)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	errs = append(errs, l.errs...)
+	l.errs = nil
+	return errs
+}
+
+// closeError gathers the errors which occurred while closing the adapter.
+type closeError []error
+
+func (e closeError) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return fmt.Sprintf("mongodbadapter: closing: %s", strings.Join(msgs, "; "))
+}
+
+// Unwrap returns the gathered errors, so that errors.Is and errors.As look
+// into each of them.
+func (e closeError) Unwrap() []error {
+	return e
+}
@@ -0,0 +1,41 @@
+// Copyright 2017 The casbin Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongodbadapter
+
+import "time"
+
+// Metrics receives measurements of the operations the adapter runs through
+// its middleware chain (see Use), e.g. to export them as Prometheus
+// histograms and counters labelled by operation. Its methods are called
+// synchronously, possibly concurrently, and should be cheap.
+type Metrics interface {
+	// ObserveDuration records how long the operation named op, e.g.
+	// "LoadPolicy", took, whether it succeeded or not.
+	ObserveDuration(op string, d time.Duration)
+	// IncError counts a failure of the operation named op.
+	IncError(op string)
+}
+
+// observe reports the operation named op, started at start and ending with
+// err, to the adapter's metrics, if any.
+func (a *adapter) observe(op string, start time.Time, err error) {
+	if a.metrics == nil {
+		return
+	}
+	a.metrics.ObserveDuration(op, time.Since(start))
+	if err != nil {
+		a.metrics.IncError(op)
+	}
+}
@@ -0,0 +1,90 @@
+// Copyright 2017 The casbin Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongodbadapter
+
+import (
+	"context"
+	"time"
+
+	"github.com/globalsign/mgo"
+)
+
+// OpFunc performs the adapter operation named op, e.g. "AddPolicy".
+type OpFunc func(op string) error
+
+// Middleware wraps an operation, typically doing some work before and after
+// calling next.
+type Middleware func(next OpFunc) OpFunc
+
+// Use appends mw to the middleware chain every adapter operation runs
+// through: LoadPolicy, LoadFilteredPolicy, LoadChangedSince,
+// LoadPolicyFromCollections, DiffPolicy, DiffCollections, SavePolicy,
+// AddPolicy, AddPolicyWithTTL, AddPolicyIfNotExists, AddPolicies, AddRules,
+// UpdatePolicy, UpdatePolicies, UpdateFilteredPolicies, RemovePolicy,
+// RemovePolicies, RemoveFilteredPolicy, RemoveFilteredPolicyByFields,
+// TagFiltered, ClearPolicy, GetPoliciesForSubjects, PolicyCount,
+// RolesForUser, UsersForRole, PolicyStats, OrphanedGroupingRules, Aggregate,
+// RemovePolicyTxOps, CopyTo, whose writes into another adapter run through
+// that adapter's chain, and Flush, which inserts the rules buffered by write
+// coalescing.
+// Middleware registered first is the outermost one. Use is not safe for
+// concurrent use with the operations it wraps and should be called while
+// setting the adapter up.
+func (a *adapter) Use(mw Middleware) {
+	a.middleware = append(a.middleware, mw)
+}
+
+// run performs the operation named op through the middleware chain. Rules
+// buffered by write coalescing are flushed before any operation other than
+// AddPolicy and Flush itself, so that it observes them. If the operation fails because the
+// connection broke, the session is refreshed so that the next operation
+// reconnects.
+func (a *adapter) run(op string, call func() error) error {
+	next := func(string) error {
+		if op != "AddPolicy" && op != "Flush" {
+			if err := a.Flush(); err != nil {
+				return err
+			}
+		}
+		return call()
+	}
+	for i := len(a.middleware) - 1; i >= 0; i-- {
+		next = a.middleware[i](next)
+	}
+
+	start := time.Now()
+	err := next(op)
+	a.observe(op, start, err)
+	if isConnectionError(err) && a.connected() {
+		// mgo sessions stick to their broken socket until refreshed. The
+		// collection handles share the session, so they pick up the new
+		// connection on the next operation without being rebuilt.
+		a.session.Refresh()
+	}
+	return err
+}
+
+// runCtx is like run, with call given the adapter's collection bound to ctx
+// by collectionFor, and retried according to the adapter's RetryPolicy.
+func (a *adapter) runCtx(ctx context.Context, op string, call func(c *mgo.Collection) error) error {
+	return a.run(op, func() error {
+		c, release, err := a.collectionFor(ctx)
+		if err != nil {
+			return err
+		}
+		defer release()
+		return a.retry(ctx, op, c, call)
+	})
+}
@@ -0,0 +1,249 @@
+// Copyright 2017 The casbin Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongodbadapter
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/casbin/casbin/persist"
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+// copyBatchSize is the number of rules CopyTo buffers before writing them to
+// the destination.
+const copyBatchSize = 1000
+
+// CopyTo streams every rule of this adapter's collection into dst, which must
+// be an adapter created by this package, passing each one through transform
+// first. A nil transform copies the rules as they are. Rules are read with
+// this adapter's codec and written like dst adds rules, with its codec, ids
+// and checksums. Rules are written to dst in batches, so the whole collection
+// is never held in memory; if an error occurs, the rules of the batches
+// written so far remain in dst. For that reason, reading the source is not
+// retried after a failure.
+func (a *adapter) CopyTo(dst persist.Adapter, transform func(CasbinRule) (CasbinRule, error)) error {
+	d, ok := dst.(*adapter)
+	if !ok {
+		return fmt.Errorf("mongodbadapter: unsupported copy destination %T", dst)
+	}
+
+	var batch []interface{}
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		err := d.runCtx(context.Background(), "CopyTo", func(c *mgo.Collection) error {
+			_, err := d.insert(c, batch...)
+			return err
+		})
+		batch = batch[:0]
+		return err
+	}
+
+	return a.run("CopyTo", func() error {
+		c, release, err := a.collectionFor(context.Background())
+		if err != nil {
+			return err
+		}
+		defer release()
+
+		var raw bson.Raw
+		iter := c.Find(nil).Iter()
+		for iter.Next(&raw) {
+			ptype, tokens, err := a.decode(raw)
+			if err != nil {
+				iter.Close()
+				return err
+			}
+			rule := savePolicyLine(ptype, tokens)
+			if transform != nil {
+				if rule, err = transform(rule); err != nil {
+					iter.Close()
+					return err
+				}
+			}
+			sec := ""
+			if rule.PType != "" {
+				sec = rule.PType[:1]
+			}
+
+			doc, err := d.encode(sec, rule.PType, policyTokens(rule))
+			if err != nil {
+				iter.Close()
+				return err
+			}
+			batch = append(batch, doc)
+			if len(batch) == copyBatchSize {
+				if err := flush(); err != nil {
+					iter.Close()
+					return err
+				}
+			}
+		}
+		if err := iter.Close(); err != nil {
+			return err
+		}
+
+		return flush()
+	})
+}
+
+// defaultMigrationBatchSize is the batch size of a Migrator that does not
+// set one.
+const defaultMigrationBatchSize = 1000
+
+// Migrator copies every rule of a source adapter's collection into a
+// destination adapter's collection, in batches ordered by _id. After each
+// batch it records the _id of the last copied rule in LastID and reports it
+// to Checkpoint, so that an interrupted migration can resume where it
+// stopped by running a Migrator with the same LastID.
+//
+// Rules keep their _id in the destination and are upserted by it, so copying
+// a batch again after a crash does not duplicate it. The source documents'
+// _id must be ObjectIds, as written by the adapter.
+type Migrator struct {
+	// Transform, if not nil, is applied to every rule before writing it.
+	Transform func(CasbinRule) (CasbinRule, error)
+	// BatchSize is the number of rules read and written at once. It
+	// defaults to 1000.
+	BatchSize int
+	// LastID is the _id of the last rule copied, if any. The migration
+	// resumes after it.
+	LastID bson.ObjectId
+	// Checkpoint, if not nil, is called with LastID after every batch. An
+	// error stops the migration.
+	Checkpoint func(lastID bson.ObjectId) error
+
+	src, dst *adapter
+}
+
+// NewMigrator returns a Migrator copying rules from src to dst, which must
+// both be adapters created by this package.
+func NewMigrator(src, dst persist.Adapter) (*Migrator, error) {
+	s, ok := src.(*adapter)
+	if !ok {
+		return nil, fmt.Errorf("mongodbadapter: unsupported migration source %T", src)
+	}
+	d, ok := dst.(*adapter)
+	if !ok {
+		return nil, fmt.Errorf("mongodbadapter: unsupported migration destination %T", dst)
+	}
+	return &Migrator{src: s, dst: d}, nil
+}
+
+// Run copies the rules following LastID until all of them are copied, an
+// error occurs or ctx is done. It can be called again to resume.
+func (m *Migrator) Run(ctx context.Context) error {
+	batchSize := m.BatchSize
+	if batchSize <= 0 {
+		batchSize = defaultMigrationBatchSize
+	}
+
+	for {
+		n, err := m.runBatch(ctx, batchSize)
+		if err != nil || n < batchSize {
+			return err
+		}
+	}
+}
+
+// runBatch copies the next batch of rules and returns its size.
+func (m *Migrator) runBatch(ctx context.Context, batchSize int) (int, error) {
+	src, releaseSrc, err := m.src.collectionFor(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer releaseSrc()
+	dst, releaseDst, err := m.dst.collectionFor(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer releaseDst()
+
+	selector := bson.M{}
+	if m.LastID != "" {
+		selector["_id"] = bson.M{"$gt": m.LastID}
+	}
+	var batch []CasbinRule
+	if err := src.Find(selector).Sort("_id").Limit(batchSize).All(&batch); err != nil {
+		return 0, err
+	}
+	if len(batch) == 0 {
+		return 0, nil
+	}
+
+	bulk := dst.Bulk()
+	bulk.Unordered()
+	for _, line := range batch {
+		rule := line
+		if m.Transform != nil {
+			if rule, err = m.Transform(line); err != nil {
+				return 0, err
+			}
+		}
+		if rule.ID == "" {
+			rule.ID = line.ID
+		}
+		bulk.Upsert(bson.M{"_id": rule.ID}, rule)
+	}
+	if _, err := bulk.Run(); err != nil {
+		return 0, err
+	}
+
+	m.LastID = batch[len(batch)-1].ID
+	if m.Checkpoint != nil {
+		if err := m.Checkpoint(m.LastID); err != nil {
+			return 0, err
+		}
+	}
+	return len(batch), nil
+}
+
+// legacyFieldNames maps the capitalized field names some tools and drivers
+// store CasbinRule fields under to the names the adapter reads.
+var legacyFieldNames = bson.M{
+	"PType":  "ptype",
+	"V0":     "v0",
+	"V1":     "v1",
+	"V2":     "v2",
+	"V3":     "v3",
+	"V4":     "v4",
+	"V5":     "v5",
+	"VExtra": "vextra",
+}
+
+// MigrateFieldNames renames the capitalized fields ("PType", "V0" to "V5" and
+// "VExtra") of every document holding any to the lowercase names the adapter
+// reads, with a single update. The adapter itself always wrote lowercase
+// names, but documents written by other tools or drivers, from a struct
+// without bson tags, use the Go field names and are otherwise loaded as empty
+// rules. A document holding both names of a field keeps the value of the
+// capitalized one. Running it again once done changes nothing.
+func (a *adapter) MigrateFieldNames(ctx context.Context) error {
+	c, release, err := a.collectionFor(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	var legacy []bson.M
+	for name := range legacyFieldNames {
+		legacy = append(legacy, bson.M{name: bson.M{"$exists": true}})
+	}
+	_, err = c.UpdateAll(bson.M{"$or": legacy}, bson.M{"$rename": legacyFieldNames})
+	return err
+}
@@ -0,0 +1,491 @@
+// Copyright 2017 The casbin Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongodbadapter
+
+import (
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+// Option configures an adapter at construction time.
+type Option func(*adapter)
+
+func (a *adapter) apply(opts []Option) {
+	for _, opt := range opts {
+		opt(a)
+	}
+}
+
+// WithArchiveCollection makes RemovePolicy and RemoveFilteredPolicy copy
+// every removed rule into the named collection, in the same database, before
+// deleting it. Archived documents carry the original rule fields plus the
+// id of the removed document ("ruleId") and the time of removal
+// ("deletedAt").
+//
+// MongoDB only offers multi-document transactions from 4.0 on, and mgo does
+// not expose them, so the copy and the delete are not atomic: the archive is
+// written first, which means a failed delete can leave an archived rule that
+// is still active, but a removed rule is never missing from the archive.
+func WithArchiveCollection(name string) Option {
+	return func(a *adapter) {
+		a.archiveName = name
+	}
+}
+
+// WithSkipUnknownPolicyTypes makes LoadPolicy silently skip stored rules whose
+// policy type is not defined in the model being loaded into, e.g. leftover
+// "g3" rules after the model dropped that role definition. By default
+// LoadPolicy fails with an UnknownPolicyTypesError listing every unknown
+// policy type it came across, leaving the model as it was.
+func WithSkipUnknownPolicyTypes() Option {
+	return func(a *adapter) {
+		a.skipUnknownPTypes = true
+	}
+}
+
+// WithUniqueIndex makes the adapter create a unique partial compound index
+// over (ptype, v0, ..., v5), so that storing the same rule twice fails with a
+// duplicate key error instead of silently creating a duplicate document.
+//
+// MongoDB puts a few constraints on partial unique indexes that callers
+// should be aware of:
+//
+//   - Uniqueness is only enforced among documents matching the partial filter
+//     (here: non-empty ptype and v0); other documents may duplicate freely.
+//   - The filter may only use equality, $exists: true, $gt, $gte, $lt, $lte,
+//     $type and a top-level $and, which is why "non-empty" is expressed as
+//     {$gt: ""} rather than {$ne: ""}.
+//   - A query only uses the index when its predicate implies the filter.
+//   - The index cannot also be sparse, and it requires MongoDB 3.2 or later.
+//   - Building the index fails if the collection already holds duplicate
+//     rules; those have to be removed first.
+//
+// Values beyond the sixth one are not part of the index, so rules which only
+// differ by those are considered duplicates.
+func WithUniqueIndex() Option {
+	return func(a *adapter) {
+		a.uniqueIndex = true
+	}
+}
+
+// WithIgnoreDuplicates makes adding a rule which is already stored a no-op
+// rather than an error, so that AddPolicy, AddPolicies and AddRules can
+// safely be retried. It implies WithUniqueIndex, whose index is what detects
+// the duplicates, and shares its limits: rules with an empty v0 are not
+// deduplicated, and adding rules longer than six values fails rather than
+// risking to drop them as duplicates of rules sharing their first six values.
+// Several rules added at once are inserted independently of each other, so a
+// duplicate does not prevent the other rules from being added.
+func WithIgnoreDuplicates() Option {
+	return func(a *adapter) {
+		a.uniqueIndex = true
+		a.ignoreDuplicates = true
+	}
+}
+
+// WithIDFactory sets the function generating the _id of every document the
+// adapter inserts, e.g. to get reproducible ids in golden tests. By default
+// bson.NewObjectId is used.
+func WithIDFactory(factory func() bson.ObjectId) Option {
+	return func(a *adapter) {
+		a.idFactory = factory
+	}
+}
+
+// WithCodec sets the Codec converting rules to and from stored documents.
+// By default DefaultCodec is used.
+func WithCodec(codec Codec) Option {
+	return func(a *adapter) {
+		a.codec = codec
+	}
+}
+
+// WithAtomicSave makes SavePolicy write the new policy into a staging
+// collection and rename it over the live one once it is complete, instead of
+// dropping the live collection and inserting the rules into it.
+//
+// MongoDB transactions are not available through mgo, so this is how
+// SavePolicy avoids the window in which the collection is empty or only
+// partially written: readers and change stream consumers never observe the
+// intermediate state. Consumers watching the collection receive a single
+// "invalidate" event when the rename replaces it, after which they have to
+// reopen their stream and reload the whole policy. The rename requires the
+// privilege to run renameCollection on the database.
+func WithAtomicSave() Option {
+	return func(a *adapter) {
+		a.atomicSave = true
+	}
+}
+
+// WithTransactionalSave makes SavePolicy replace the stored policy in a
+// single step, as a transaction would. mgo cannot run MongoDB transactions,
+// so this selects the staging collection and rename of WithAtomicSave, which
+// gives readers the same guarantee: they see either the old or the new
+// policy, never an empty or partial one. The caveats of WithAtomicSave
+// apply, including that sharded collections cannot be saved this way.
+func WithTransactionalSave() Option {
+	return WithAtomicSave()
+}
+
+// WithPing makes NewAdapterWithDB ping the server through the provided
+// database's session before using it, so that a dead or misconfigured shared
+// connection fails the construction instead of the first policy operation.
+// NewAdapter dials the server itself and needs no such check.
+func WithPing() Option {
+	return func(a *adapter) {
+		a.pingOnOpen = true
+	}
+}
+
+// WithLazyConnect makes NewAdapter, NewAdapterWithError and
+// NewAdapterWithDialInfo return without dialing the server, e.g. for services
+// starting before MongoDB is reachable. The adapter connects and sets up its
+// collection and indexes on its first operation, which fails with the error
+// of the connection attempt, e.g. one matching ErrUnreachable, while the
+// server cannot be reached; every following operation tries again. Ping
+// connects without querying the policy, e.g. from a readiness probe. It has
+// no effect on the adapters given a database or a session.
+func WithLazyConnect() Option {
+	return func(a *adapter) {
+		a.lazyConnect = true
+	}
+}
+
+// WithCollectionInfo makes the adapter explicitly create its collection with
+// the given options, e.g. a capped size or a document validator, before
+// creating the indexes, rather than relying on MongoDB to create it on the
+// first write. A collection that already exists is used as it is; its
+// options are not changed.
+func WithCollectionInfo(info *mgo.CollectionInfo) Option {
+	return func(a *adapter) {
+		a.collectionInfo = info
+	}
+}
+
+// WithChecksum makes the adapter store an HMAC-SHA256 of each rule's policy
+// type and values, keyed with key, alongside every rule it inserts, and
+// verify it for every rule it loads. A rule whose checksum is missing or
+// wrong, e.g. because it was modified directly in the database, makes
+// LoadPolicy fail with ErrInvalidChecksum, unless WithSkipInvalidChecksums is
+// used.
+//
+// The key is the only secret protecting the policy: it must be kept out of
+// the database, e.g. in a secrets manager, and be available to every adapter
+// reading the collection. Rules written before the checksum was enabled, or
+// with a different key, fail verification, so rotating the key means
+// rewriting the whole policy with the new one, e.g. by loading it with the
+// old key and saving it with the new one.
+func WithChecksum(key []byte) Option {
+	return func(a *adapter) {
+		a.checksumKey = key
+	}
+}
+
+// WithSkipInvalidChecksums makes LoadPolicy leave out rules failing checksum
+// verification instead of failing. It has no effect without WithChecksum.
+func WithSkipInvalidChecksums() Option {
+	return func(a *adapter) {
+		a.skipInvalidChecksums = true
+	}
+}
+
+// WithRequireCollection makes LoadPolicy fail with ErrCollectionNotFound when
+// the collection does not exist, so that a missing or misconfigured store
+// can be told apart from an empty policy. By default a missing collection
+// loads as an empty policy.
+func WithRequireCollection() Option {
+	return func(a *adapter) {
+		a.requireCollection = true
+	}
+}
+
+// WithLoadProjection sets the fields LoadPolicy reads from each document,
+// e.g. bson.M{"subject": 1, "object": 1, "action": 1} for a custom Codec
+// reading those fields. By default only the fields read by DefaultCodec are
+// fetched when it is used, which saves bandwidth on documents carrying extra
+// metadata, and whole documents are fetched for any other codec.
+func WithLoadProjection(fields bson.M) Option {
+	return func(a *adapter) {
+		a.projection = fields
+	}
+}
+
+// WithWriteCoalescing makes AddPolicy buffer the rules it adds instead of
+// inserting each of them on its own, and insert the whole buffer in a single
+// request once window has passed since the first buffered rule or once
+// maxSize rules are buffered (a non-positive maxSize means no size limit).
+// The buffer is also flushed before any other operation and by Flush.
+//
+// This trades consistency for throughput: AddPolicy returns before the rule
+// is stored, a failed insert is only reported by a later operation or Flush,
+// which fail until the rules are inserted, and buffered rules are lost if the
+// process dies before they are flushed. Rules rejected as duplicates are
+// dropped from the buffer.
+// It should only be enabled where that is acceptable, and callers should
+// Flush before shutting down.
+func WithWriteCoalescing(window time.Duration, maxSize int) Option {
+	return func(a *adapter) {
+		a.addBuffer = &addBuffer{window: window, maxSize: maxSize}
+	}
+}
+
+// WithLoadSort makes LoadPolicy return rules ordered by the given keys, in
+// mgo's Sort syntax (e.g. "v0" or "-v0"), and makes the adapter create a
+// compound index on them. The index is what makes ordered loads work at
+// scale: without it the server has to sort the whole result in memory, which
+// fails once the rules exceed its in-memory sort limit (32MB before MongoDB
+// 4.4, 100MB since).
+//
+// This is meant for models whose semantics depend on rule order, such as
+// Casbin's priority model, where the priority is the first value (v0) of
+// each "p" rule. Values are strings and sort as such, so priorities should be
+// stored zero-padded ("010" rather than "10") to sort numerically.
+func WithLoadSort(keys ...string) Option {
+	return func(a *adapter) {
+		a.loadSort = keys
+	}
+}
+
+// WithLoadBatchSize sets how many rules LoadPolicy and the other loads fetch
+// per round trip, 1000 by default. The context given to LoadPolicyCtx is
+// checked between batches, while the timeout set with WithTimeout only
+// bounds each of them, so that loading millions of rules is not cut short by
+// a timeout meant for single operations. A non-positive n keeps the default.
+func WithLoadBatchSize(n int) Option {
+	return func(a *adapter) {
+		a.loadBatchSize = n
+	}
+}
+
+// WithStrictArity makes LoadPolicy fail on the first rule holding more values
+// than the model defines for its policy type, which indicates corrupted or
+// mismatched data, with an error identifying the offending document. By
+// default such rules are loaded as they are.
+func WithStrictArity() Option {
+	return func(a *adapter) {
+		a.strictArity = true
+	}
+}
+
+// WithWatchBackoff configures how the adapter's watchers reopen a failed
+// change stream. See WatchBackoff for the defaults.
+func WithWatchBackoff(backoff WatchBackoff) Option {
+	return func(a *adapter) {
+		a.watchBackoff = backoff
+	}
+}
+
+// WithRetry configures how the adapter retries operations failing with a
+// transient error. See RetryPolicy for the defaults.
+func WithRetry(policy RetryPolicy) Option {
+	return func(a *adapter) {
+		a.retryPolicy = policy
+	}
+}
+
+// WithChangeHook sets a function called after every successful change of the
+// stored policy by AddPolicy, AddPolicyWithTTL, AddPolicyIfNotExists,
+// AddPolicies, AddRules, RemovePolicy, RemovePolicies, RemoveFilteredPolicy,
+// RemoveFilteredPolicyByFields, UpdatePolicy, UpdatePolicies,
+// UpdateFilteredPolicies, SavePolicy and ClearPolicy, e.g. to feed an audit
+// log. AddRules reports each of its rules as a change of its own. Rules added
+// through write coalescing are reported once buffered. The hook is called
+// synchronously, on the goroutine of the operation, and must not modify the
+// change's rules.
+func WithChangeHook(hook func(PolicyChange)) Option {
+	return func(a *adapter) {
+		a.changeHook = hook
+	}
+}
+
+// WithCredential authenticates with cred rather than with the credentials of
+// the URL or dial info, e.g. with a password handed by a secrets manager,
+// which then needs no URL encoding. Username, Password, Source (the
+// authentication database), Mechanism, Service and ServiceHost are used;
+// Certificate is not supported. Constructors given a session or a database
+// ignore it.
+func WithCredential(cred mgo.Credential) Option {
+	return func(a *adapter) {
+		a.credential = &cred
+	}
+}
+
+// WithPool configures the connection pool of the session the adapter dials,
+// see PoolOptions. Constructors given a session or a database ignore it.
+func WithPool(options PoolOptions) Option {
+	return func(a *adapter) {
+		a.pool = options
+	}
+}
+
+// WithFieldNames stores the policy type and the rule values in the given
+// fields rather than in "ptype" and "v0" to "v5", e.g.
+// WithFieldNames("type", "subject", "object", "action") to adopt a collection
+// written by another system without migrating it. It replaces the codec and
+// also applies to the indexes the adapter creates and to the selectors of
+// RemoveFilteredPolicy, RemoveFilteredPolicyByFields, TagFiltered, Filter,
+// GetPoliciesForSubjects, RolesForUser and UsersForRole. Up to six value
+// fields can be named, names beyond the sixth one being ignored, and adding
+// a rule with more values than named fields fails. The other helpers, such
+// as PolicyStats, DiffCollections and the watchers, keep assuming the
+// default field layout.
+func WithFieldNames(ptype string, values ...string) Option {
+	return func(a *adapter) {
+		a.codec, a.fieldNames = newNamedFields(ptype, values)
+	}
+}
+
+// WithMetrics reports the duration and the failures of the adapter's
+// operations to metrics. Nothing is measured by default.
+func WithMetrics(metrics Metrics) Option {
+	return func(a *adapter) {
+		a.metrics = metrics
+	}
+}
+
+// WithUpsertKey makes AddPolicy treat the values at the given positions,
+// along with the policy type, as the identity of a rule: adding a rule whose
+// key matches a stored one updates that rule's other values in place instead
+// of inserting another document. For example WithUpsertKey(0, 1) keys rules
+// by subject and object. Upserted rules bypass write coalescing.
+func WithUpsertKey(fields ...int) Option {
+	return func(a *adapter) {
+		a.upsertKey = fields
+	}
+}
+
+// WithTimestamps makes the adapter record the time every rule was written in
+// an "updatedAt" field, and index it, so that LoadChangedSince can load the
+// rules written since a given time. Rules written before the option was
+// enabled, or by other means, have no such field.
+func WithTimestamps() Option {
+	return func(a *adapter) {
+		a.timestamps = true
+	}
+}
+
+// WithTTLIndex creates a TTL index on the "expireAt" field, which makes
+// MongoDB remove the rules added with AddPolicyWithTTL once they expire.
+func WithTTLIndex() Option {
+	return func(a *adapter) {
+		a.ttlIndex = true
+	}
+}
+
+// WithFallbackCodecs makes the adapter try the given codecs, in order, on the
+// documents its codec cannot decode, so that a collection mixing several
+// layouts can be loaded, e.g. while migrating from one to another. Rules are
+// still written with the adapter's codec only.
+func WithFallbackCodecs(codecs ...Codec) Option {
+	return func(a *adapter) {
+		a.fallbackCodecs = codecs
+	}
+}
+
+// WithCollectionName stores the rules in the named collection rather than in
+// "casbin_rule", e.g. to keep several independent policies in one database.
+// An empty name keeps the default.
+func WithCollectionName(name string) Option {
+	return func(a *adapter) {
+		a.collectionName = name
+	}
+}
+
+// WithDatabaseName stores the rules in the named database, whatever the
+// database of the URL or dial info, which is still the one authenticated
+// against unless authSource says otherwise. It has no effect with
+// NewAdapterWithDB, which is given its database.
+func WithDatabaseName(name string) Option {
+	return func(a *adapter) {
+		a.databaseName = name
+	}
+}
+
+// WithTimeout bounds the time NewAdapter spends connecting to the server, and
+// every network round trip of the operations not given a context deadline.
+// A zero timeout keeps mgo's defaults.
+func WithTimeout(timeout time.Duration) Option {
+	return func(a *adapter) {
+		a.timeout = timeout
+	}
+}
+
+// WithIndexes replaces the compound index the adapter creates on ptype and
+// v0 to v5 with the given ones, e.g. indexes matching the queries of the
+// application. The indexes required by other options, such as
+// WithUniqueIndex, are still created.
+func WithIndexes(indexes ...mgo.Index) Option {
+	return func(a *adapter) {
+		a.indexes = append([]mgo.Index{}, indexes...)
+	}
+}
+
+// WithIndexOptions sets how the adapter builds the indexes it creates, see
+// IndexOptions. Existing indexes are not rebuilt.
+func WithIndexOptions(options IndexOptions) Option {
+	return func(a *adapter) {
+		a.indexOptions = options
+	}
+}
+
+// WithCaseInsensitive makes the adapter compare rule values regardless of
+// their case, e.g. "Alice" and "alice", when it looks rules up: loads with a
+// filter, RemovePolicy, RemoveFilteredPolicy and the role queries. The
+// indexes it creates get the same case-insensitive collation, unless
+// IndexOptions sets another one, so that these queries can use them; with
+// WithUniqueIndex, rules differing only by case are then duplicates. Existing
+// indexes are not rebuilt. Enforcement itself, done by Casbin on the loaded
+// policy, stays case-sensitive.
+func WithCaseInsensitive() Option {
+	return func(a *adapter) {
+		collation := caseInsensitive
+		a.collation = &collation
+	}
+}
+
+// WithSkipIndexCreation keeps the adapter from creating any index, neither
+// when opened nor when SavePolicy recreates the collection, for deployments
+// managing their indexes themselves. CheckIndexes still reports the
+// differences with the indexes the adapter would have created.
+func WithSkipIndexCreation() Option {
+	return func(a *adapter) {
+		a.skipIndexCreation = true
+	}
+}
+
+// WithWriteConcern sets the write concern of every write of the adapter, e.g.
+// mgo.Safe{WMode: "majority", J: true} for policy changes to survive a
+// failover before AddPolicy returns. Without it, writes use the concern of
+// the session, which mgo defaults to an acknowledgment by the primary alone.
+// ContextWithWriteConcern overrides it for single operations.
+func WithWriteConcern(safe mgo.Safe) Option {
+	return func(a *adapter) {
+		a.writeConcern = &safe
+	}
+}
+
+// WithLoadReadPreference sets where LoadPolicy, LoadFilteredPolicy and
+// LoadChangedSince read the rules from, e.g. mgo.Nearest to offload the
+// primary of a large cluster. Other operations keep the session's read
+// preference, which defaults to the primary. Secondaries may lag behind the
+// primary, so a policy loaded from them may miss the latest changes,
+// including one just made through the same adapter.
+func WithLoadReadPreference(mode mgo.Mode) Option {
+	return func(a *adapter) {
+		a.loadMode = &mode
+	}
+}
@@ -0,0 +1,55 @@
+// Copyright 2017 The casbin Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongodbadapter
+
+import (
+	"time"
+
+	"github.com/globalsign/mgo"
+)
+
+// PoolOptions configure the pool of connections the adapter's session keeps
+// to every server, see WithPool. Zero fields keep the value given by the URL
+// or dial info, or else mgo's default.
+type PoolOptions struct {
+	// MaxSize caps the number of connections, 4096 by default.
+	MaxSize int
+	// MinSize is the number of connections kept open even when idle, so
+	// that bursts of requests do not have to wait for new ones. None by
+	// default.
+	MinSize int
+	// MaxIdleTime is how long a connection beyond MinSize may stay idle
+	// before it is closed. Forever by default.
+	MaxIdleTime time.Duration
+	// Timeout is how long an operation waits for a connection once
+	// MaxSize is reached before failing. Forever by default.
+	Timeout time.Duration
+}
+
+// apply sets the non-zero options on info.
+func (o PoolOptions) apply(info *mgo.DialInfo) {
+	if o.MaxSize > 0 {
+		info.PoolLimit = o.MaxSize
+	}
+	if o.MinSize > 0 {
+		info.MinPoolSize = o.MinSize
+	}
+	if o.MaxIdleTime > 0 {
+		info.MaxIdleTimeMS = int(o.MaxIdleTime / time.Millisecond)
+	}
+	if o.Timeout > 0 {
+		info.PoolTimeout = o.Timeout
+	}
+}
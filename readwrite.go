@@ -0,0 +1,67 @@
+// Copyright 2017 The casbin Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongodbadapter
+
+import (
+	"github.com/casbin/casbin/model"
+	"github.com/casbin/casbin/persist"
+)
+
+// readWriteAdapter splits policy storage between two adapters backed by the
+// same collection: one serving reads and one taking writes.
+type readWriteAdapter struct {
+	writer persist.Adapter
+	reader persist.Adapter
+}
+
+// NewReadWriteAdapter is the constructor for an Adapter that loads policy
+// through reader and sends every change through writer. Both are expected to
+// point at the same collection, typically with reader connected through a
+// URL that prefers secondaries, e.g.
+//
+//	writer := mongodbadapter.NewAdapter("db1,db2,db3/casbin")
+//	reader := mongodbadapter.NewAdapter("db1,db2,db3/casbin?readPreference=secondaryPreferred")
+//	a := mongodbadapter.NewReadWriteAdapter(writer, reader)
+//
+// Reads from a secondary may lag behind the writes just made through the
+// primary, so a LoadPolicy right after a change may not reflect it yet.
+func NewReadWriteAdapter(writer, reader persist.Adapter) persist.Adapter {
+	return &readWriteAdapter{writer: writer, reader: reader}
+}
+
+// LoadPolicy loads policy from the reader.
+func (a *readWriteAdapter) LoadPolicy(model model.Model) error {
+	return a.reader.LoadPolicy(model)
+}
+
+// SavePolicy saves policy through the writer.
+func (a *readWriteAdapter) SavePolicy(model model.Model) error {
+	return a.writer.SavePolicy(model)
+}
+
+// AddPolicy adds a policy rule through the writer.
+func (a *readWriteAdapter) AddPolicy(sec string, ptype string, rule []string) error {
+	return a.writer.AddPolicy(sec, ptype, rule)
+}
+
+// RemovePolicy removes a policy rule through the writer.
+func (a *readWriteAdapter) RemovePolicy(sec string, ptype string, rule []string) error {
+	return a.writer.RemovePolicy(sec, ptype, rule)
+}
+
+// RemoveFilteredPolicy removes policy rules that match the filter through the writer.
+func (a *readWriteAdapter) RemoveFilteredPolicy(sec string, ptype string, fieldIndex int, fieldValues ...string) error {
+	return a.writer.RemoveFilteredPolicy(sec, ptype, fieldIndex, fieldValues...)
+}
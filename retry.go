@@ -0,0 +1,133 @@
+// Copyright 2017 The casbin Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongodbadapter
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/globalsign/mgo"
+)
+
+// RetryPolicy configures how operations failing with a transient error, e.g.
+// while the replica set elects a new primary, are retried. Writes are only
+// retried on errors telling that the server did not apply them, such as "not
+// master"; loads are also retried on broken connections. Successive retries
+// wait exponentially longer, starting from Backoff.
+type RetryPolicy struct {
+	// Attempts is how many times an operation is tried at most, 2 by
+	// default. 1 disables retries.
+	Attempts int
+	// Backoff is the delay before the first retry, 100ms by default.
+	Backoff time.Duration
+}
+
+// defaultRetryPolicy is used unless WithRetry is given.
+var defaultRetryPolicy = RetryPolicy{
+	Attempts: 2,
+	Backoff:  100 * time.Millisecond,
+}
+
+// withDefaults returns p with its zero fields set to their default value.
+func (p RetryPolicy) withDefaults() RetryPolicy {
+	if p.Attempts <= 0 {
+		p.Attempts = defaultRetryPolicy.Attempts
+	}
+	if p.Backoff <= 0 {
+		p.Backoff = defaultRetryPolicy.Backoff
+	}
+	return p
+}
+
+// readOps are the operations which only read, and can therefore be retried
+// after any connection failure.
+var readOps = map[string]bool{
+	"LoadPolicy":                true,
+	"LoadFilteredPolicy":        true,
+	"LoadChangedSince":          true,
+	"DiffPolicy":                true,
+	"LoadPolicyFromCollections": true,
+	"GetPoliciesForSubjects":    true,
+	"PolicyCount":               true,
+	"RolesForUser":              true,
+	"UsersForRole":              true,
+	"PolicyStats":               true,
+	"OrphanedGroupingRules":     true,
+	"DiffCollections":           true,
+	"RemovePolicyTxOps":         true,
+}
+
+// Server error codes meaning that the server refused an operation without
+// applying it because it is not, or no longer, the primary.
+var notPrimaryCodes = map[int]bool{
+	91:    true, // ShutdownInProgress
+	189:   true, // PrimarySteppedDown
+	10107: true, // NotMaster
+	11600: true, // InterruptedAtShutdown
+	11602: true, // InterruptedDueToReplStateChange
+	13435: true, // NotMasterNoSlaveOk
+	13436: true, // NotMasterOrSecondary
+}
+
+// isTransientError reports whether the operation failing with err is worth
+// retrying. Connection failures only are for reads, since a write may have
+// been applied before the connection broke.
+func isTransientError(err error, read bool) bool {
+	switch e := err.(type) {
+	case nil:
+		return false
+	case *mgo.QueryError:
+		return notPrimaryCodes[e.Code]
+	case *mgo.LastError:
+		return notPrimaryCodes[e.Code]
+	case *mgo.BulkError:
+		cases := e.Cases()
+		for _, c := range cases {
+			if !isTransientError(c.Err, false) {
+				return false
+			}
+		}
+		return len(cases) > 0
+	}
+	if read && isConnectionError(err) {
+		return true
+	}
+	return strings.Contains(err.Error(), "not master")
+}
+
+// retry calls call, with c, until it succeeds, fails with an error that is
+// not transient or runs out of attempts. c's session is refreshed before
+// every retry, so that it leaves a broken connection or a former primary.
+func (a *adapter) retry(ctx context.Context, op string, c *mgo.Collection, call func(c *mgo.Collection) error) error {
+	policy := a.retryPolicy.withDefaults()
+	delay := policy.Backoff
+	for attempt := 1; ; attempt++ {
+		err := call(c)
+		if attempt >= policy.Attempts || !isTransientError(err, readOps[op]) {
+			return err
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+		delay *= 2
+		c.Database.Session.Refresh()
+	}
+}
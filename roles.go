@@ -0,0 +1,56 @@
+// Copyright 2017 The casbin Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongodbadapter
+
+import (
+	"context"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+// RolesForUser returns the roles directly granted to subject by rules of the
+// given grouping policy type ("g" if empty), i.e. the v1 values of the rules
+// whose v0 is subject. Roles inherited through other roles are not included.
+func (a *adapter) RolesForUser(subject string, ptype string) ([]string, error) {
+	if ptype == "" {
+		ptype = "g"
+	}
+
+	var roles []string
+	selector := a.renameFields(bson.M{"ptype": ptype, "v0": subject})
+	err := a.runCtx(context.Background(), "RolesForUser", func(c *mgo.Collection) error {
+		return a.find(c, selector).Distinct(a.fieldName("v1"), &roles)
+	})
+	return roles, err
+}
+
+// UsersForRole returns the subjects directly granted role by rules of the
+// given grouping policy type ("g" if empty), i.e. the v0 values of the rules
+// whose v1 is role. v1 is not a prefix of the default rule index, which only
+// narrows the query down to the policy type; WithIndexes can add an index on
+// ptype and v1 for large policies.
+func (a *adapter) UsersForRole(role string, ptype string) ([]string, error) {
+	if ptype == "" {
+		ptype = "g"
+	}
+
+	var users []string
+	selector := a.renameFields(bson.M{"ptype": ptype, "v1": role})
+	err := a.runCtx(context.Background(), "UsersForRole", func(c *mgo.Collection) error {
+		return a.find(c, selector).Distinct(a.fieldName("v0"), &users)
+	})
+	return users, err
+}
@@ -0,0 +1,85 @@
+// Copyright 2017 The casbin Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongodbadapter
+
+import (
+	"context"
+
+	"github.com/casbin/casbin/model"
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+// stagingSuffix is appended to the collection name, along with a unique id,
+// to name the collection saveAtomically writes the new policy into.
+const stagingSuffix = "_staging_"
+
+// saveAtomically writes the policy into a staging collection, indexes it and
+// then renames it over the live collection, so that readers switch from the
+// old policy to the new one in a single step. Every save gets a staging
+// collection of its own, so that concurrent saves do not mix their rules,
+// and drops it unless the rename succeeds. The live collection is left
+// untouched if ctx is done before the rename.
+func (a *adapter) saveAtomically(ctx context.Context, c *mgo.Collection, model model.Model) (err error) {
+	lines, err := a.savePolicyLines(model)
+	if err != nil {
+		return err
+	}
+
+	db := c.Database
+	staging := db.C(c.Name + stagingSuffix + bson.NewObjectId().Hex())
+	defer func() {
+		if err != nil {
+			dropCollection(staging)
+		}
+	}()
+	if err := a.resetCollection(staging); err != nil {
+		return err
+	}
+	if len(lines) > 0 {
+		if err := staging.Insert(lines...); err != nil {
+			return err
+		}
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return db.Session.Run(bson.D{
+		{Name: "renameCollection", Value: staging.FullName},
+		{Name: "to", Value: c.FullName},
+		{Name: "dropTarget", Value: true},
+	}, nil)
+}
+
+// resetCollection drops c and creates it again, empty, with the options and
+// indexes the adapter was opened with, so that reseeding the policy does not
+// lose a validator or the indexes.
+func (a *adapter) resetCollection(c *mgo.Collection) error {
+	if err := dropCollection(c); err != nil {
+		return err
+	}
+
+	if a.collectionInfo != nil {
+		if err := createCollection(c, a.collectionInfo); err != nil {
+			return err
+		}
+	}
+
+	// mgo remembers the indexes it ensured and would not create them again
+	// on the new collection.
+	c.Database.Session.ResetIndexCache()
+	return a.ensureIndexes(c)
+}
@@ -0,0 +1,231 @@
+// Copyright 2017 The casbin Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongodbadapter
+
+import (
+	"context"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+// IndexUsageStats returns the output of the $indexStats aggregation stage for
+// the adapter's collection: one document per index, holding its name, key
+// and an "accesses" sub-document counting the operations that used it since
+// the server started. It requires MongoDB 3.2 or later.
+func (a *adapter) IndexUsageStats(ctx context.Context) ([]bson.M, error) {
+	c, release, err := a.collectionFor(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	var stats []bson.M
+	pipeline := []bson.M{{"$indexStats": bson.M{}}}
+	if err := c.Pipe(pipeline).All(&stats); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// Aggregate runs a caller-supplied aggregation pipeline, typically a
+// []bson.M, against the adapter's collection and returns the iterator over
+// its results. The caller owns the iterator and must Close it. A ctx deadline
+// is passed to the server as the pipeline's maximum execution time.
+//
+// The pipeline goes through the middleware and metrics like other operations,
+// but the iterator outlives the call, so it runs on the adapter's own session
+// rather than one bound to ctx, and is not retried.
+func (a *adapter) Aggregate(ctx context.Context, pipeline interface{}) (*mgo.Iter, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	var iter *mgo.Iter
+	err := a.run("Aggregate", func() error {
+		if err := a.connect(); err != nil {
+			return err
+		}
+		pipe := a.collection.Pipe(pipeline)
+		if deadline, ok := ctx.Deadline(); ok {
+			pipe.SetMaxTime(time.Until(deadline))
+		}
+		iter = pipe.Iter()
+		return iter.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return iter, nil
+}
+
+// OrphanedGroupingRules returns the "g" rules granting a role that has no
+// policy rule of its own, i.e. whose role (v1) never appears as the subject
+// (v0) of a rule of any "p" policy type.
+//
+// It assumes the usual role definition layout, where v0 holds the member and
+// v1 the role; other grouping types such as "g2" are not inspected because
+// their values usually refer to objects rather than subjects. Roles that only
+// get their permissions through another role (role hierarchies) are reported
+// as well. The aggregation uses $lookup with a sub-pipeline, which requires
+// MongoDB 3.6 or later.
+func (a *adapter) OrphanedGroupingRules() ([]CasbinRule, error) {
+	var rules []CasbinRule
+	err := a.runCtx(context.Background(), "OrphanedGroupingRules", func(c *mgo.Collection) error {
+		return c.Pipe(orphanedGroupingPipeline(c.Name)).All(&rules)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// orphanedGroupingPipeline returns the aggregation pipeline of
+// OrphanedGroupingRules on the named collection.
+func orphanedGroupingPipeline(collection string) []bson.M {
+	return []bson.M{
+		{"$match": bson.M{"ptype": "g"}},
+		{"$lookup": bson.M{
+			"from": collection,
+			"let":  bson.M{"role": "$v1"},
+			"pipeline": []bson.M{
+				{"$match": bson.M{
+					"ptype": bson.M{"$regex": "^p"},
+					"$expr": bson.M{"$eq": []string{"$v0", "$$role"}},
+				}},
+				{"$limit": 1},
+			},
+			"as": "grants",
+		}},
+		{"$match": bson.M{"grants": bson.M{"$size": 0}}},
+		{"$project": bson.M{"grants": 0}},
+	}
+}
+
+// PolicyStats summarizes the shape of the stored policy.
+type PolicyStats struct {
+	// Rules is the number of rules per policy type.
+	Rules map[string]int64
+	// Subjects and Objects are the number of distinct subjects (v0) and
+	// objects (v1) among the rules of the "p" policy types.
+	Subjects int64
+	Objects  int64
+	// AverageTokens is the average number of non-empty values per rule.
+	AverageTokens float64
+}
+
+// PolicyStats computes a PolicyStats with a single aggregation, without
+// loading the rules. It assumes the default field layout and uses $facet,
+// which requires MongoDB 3.4 or later.
+func (a *adapter) PolicyStats() (PolicyStats, error) {
+	countDistinct := func(field string) []bson.M {
+		return []bson.M{
+			{"$match": bson.M{"ptype": bson.M{"$regex": "^p"}}},
+			{"$group": bson.M{"_id": "$" + field}},
+			{"$count": "n"},
+		}
+	}
+	tokens := bson.M{"$add": []bson.M{
+		{"$size": bson.M{"$filter": bson.M{
+			"input": []string{"$v0", "$v1", "$v2", "$v3", "$v4", "$v5"},
+			"as":    "v",
+			"cond": bson.M{"$and": []bson.M{
+				{"$ne": []interface{}{"$$v", nil}},
+				{"$ne": []interface{}{"$$v", ""}},
+			}},
+		}}},
+		{"$size": bson.M{"$ifNull": []interface{}{"$vextra", []string{}}}},
+	}}
+	pipeline := []bson.M{{"$facet": bson.M{
+		"rules":    []bson.M{{"$group": bson.M{"_id": "$ptype", "n": bson.M{"$sum": 1}}}},
+		"subjects": countDistinct("v0"),
+		"objects":  countDistinct("v1"),
+		"tokens":   []bson.M{{"$group": bson.M{"_id": nil, "avg": bson.M{"$avg": tokens}}}},
+	}}}
+
+	type count struct {
+		ID string `bson:"_id"`
+		N  int64  `bson:"n"`
+	}
+	var result struct {
+		Rules    []count `bson:"rules"`
+		Subjects []count `bson:"subjects"`
+		Objects  []count `bson:"objects"`
+		Tokens   []struct {
+			Avg float64 `bson:"avg"`
+		} `bson:"tokens"`
+	}
+	err := a.runCtx(context.Background(), "PolicyStats", func(c *mgo.Collection) error {
+		return c.Pipe(pipeline).One(&result)
+	})
+	if err != nil {
+		return PolicyStats{}, err
+	}
+
+	stats := PolicyStats{Rules: make(map[string]int64, len(result.Rules))}
+	for _, c := range result.Rules {
+		stats.Rules[c.ID] = c.N
+	}
+	if len(result.Subjects) > 0 {
+		stats.Subjects = result.Subjects[0].N
+	}
+	if len(result.Objects) > 0 {
+		stats.Objects = result.Objects[0].N
+	}
+	if len(result.Tokens) > 0 {
+		stats.AverageTokens = result.Tokens[0].Avg
+	}
+	return stats, nil
+}
+
+// Count returns the number of documents in the collection, e.g. for startup
+// health checks confirming the policy is there, much more cheaply than
+// loading it.
+func (a *adapter) Count(ctx context.Context) (int64, error) {
+	c, release, err := a.collectionFor(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+
+	n, err := c.Count()
+	return int64(n), err
+}
+
+// CountByPType returns the number of rules of every policy type, with a
+// single aggregation.
+func (a *adapter) CountByPType(ctx context.Context) (map[string]int64, error) {
+	c, release, err := a.collectionFor(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	var counts []struct {
+		ID string `bson:"_id"`
+		N  int64  `bson:"n"`
+	}
+	pipeline := []bson.M{{"$group": bson.M{"_id": "$ptype", "n": bson.M{"$sum": 1}}}}
+	if err := c.Pipe(pipeline).All(&counts); err != nil {
+		return nil, err
+	}
+
+	res := make(map[string]int64, len(counts))
+	for _, count := range counts {
+		res[count.ID] = count.N
+	}
+	return res, nil
+}
@@ -0,0 +1,59 @@
+// Copyright 2017 The casbin Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongodbadapter
+
+import (
+	"context"
+	"time"
+
+	"github.com/casbin/casbin/model"
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+// updatedAtField is the document field holding the time a rule was written,
+// see WithTimestamps.
+const updatedAtField = "updatedAt"
+
+// LoadChangedSince adds to the model the rules written at or after since
+// which it does not hold yet, allowing to poll for new rules much more
+// cheaply than with a full LoadPolicy. It requires the adapter to be
+// configured with WithTimestamps, which also creates the index on
+// "updatedAt" the query relies on. Removed rules leave no trace to load, so
+// a periodic full load is still needed to notice removals.
+func (a *adapter) LoadChangedSince(model model.Model, since time.Time) error {
+	ctx := context.Background()
+	return a.runCtx(ctx, "LoadChangedSince", func(c *mgo.Collection) error {
+		return a.loadChangedSince(ctx, c, model, since)
+	})
+}
+
+func (a *adapter) loadChangedSince(ctx context.Context, c *mgo.Collection, m model.Model, since time.Time) error {
+	changed := emptyCopy(m)
+	if err := a.readPolicy(ctx, c, changed, bson.M{updatedAtField: bson.M{"$gte": since}}); err != nil {
+		return err
+	}
+
+	for sec, assertions := range changed {
+		for ptype, ast := range assertions {
+			for _, rule := range ast.Policy {
+				if !m.HasPolicy(sec, ptype, rule) {
+					m.AddPolicy(sec, ptype, rule)
+				}
+			}
+		}
+	}
+	return nil
+}
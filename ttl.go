@@ -0,0 +1,62 @@
+// Copyright 2017 The casbin Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongodbadapter
+
+import (
+	"context"
+	"time"
+
+	"github.com/globalsign/mgo"
+)
+
+// expireAtField is the document field holding the time a rule added by
+// AddPolicyWithTTL expires, see WithTTLIndex.
+const expireAtField = "expireAt"
+
+// ttlIndex makes MongoDB remove the documents whose expireAtField is in the
+// past. mgo cannot create a TTL index expiring documents right at their
+// expiry time, so they are removed at least a second later.
+var ttlIndex = mgo.Index{Key: []string{expireAtField}, ExpireAfter: time.Second}
+
+// AddPolicyWithTTL adds a policy rule to the storage which MongoDB removes
+// once ttl has elapsed, e.g. a temporary elevated access. The removal relies
+// on the TTL index created with WithTTLIndex; MongoDB checks for expired
+// documents about once a minute, so the rule may outlive its ttl by that
+// much, and enforcers keep it until they reload the policy. Other rules
+// never expire. SavePolicy rewrites every rule without an expiry time.
+func (a *adapter) AddPolicyWithTTL(sec string, ptype string, rule []string, ttl time.Duration) error {
+	err := a.runCtx(context.Background(), "AddPolicyWithTTL", func(c *mgo.Collection) error {
+		return a.addPolicyWithTTL(c, sec, ptype, rule, ttl)
+	})
+	return a.logChange(err, PolicyChange{Op: "AddPolicyWithTTL", Sec: sec, PType: ptype, Rules: [][]string{rule}})
+}
+
+func (a *adapter) addPolicyWithTTL(c *mgo.Collection, sec string, ptype string, rule []string, ttl time.Duration) error {
+	line, err := a.encode(sec, ptype, rule)
+	if err != nil {
+		return err
+	}
+	doc, err := appendField(line, expireAtField, time.Now().Add(ttl))
+	if err != nil {
+		return err
+	}
+
+	if len(a.upsertKey) > 0 {
+		_, err = a.upsert(c, doc)
+		return err
+	}
+	_, err = a.insert(c, doc)
+	return err
+}
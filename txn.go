@@ -0,0 +1,97 @@
+// Copyright 2017 The casbin Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongodbadapter
+
+import (
+	"context"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+	"github.com/globalsign/mgo/txn"
+)
+
+// mgo does not expose MongoDB's native transactions, but its txn package
+// implements multi-document transactions on the client side. The functions
+// below return the txn operations corresponding to a policy change, so that
+// callers can run them in a txn.Runner together with changes to their own
+// collections, e.g. to create a resource and grant its owner access to it
+// atomically.
+//
+// The usual txn rules apply: once a document has been touched by a
+// transaction it must only be changed through transactions, so a rule added
+// with AddPolicyTxOp should be removed with RemovePolicyTxOps rather than
+// with RemovePolicy.
+
+// AddPolicyTxOp returns the txn operation inserting a policy rule.
+func (a *adapter) AddPolicyTxOp(sec string, ptype string, rule []string) (txn.Op, error) {
+	if err := a.connect(); err != nil {
+		return txn.Op{}, err
+	}
+	if err := a.checkRuleLength(ptype, rule); err != nil {
+		return txn.Op{}, err
+	}
+	id := a.newID()
+	doc, err := a.codec.Encode(sec, ptype, rule)
+	if err != nil {
+		return txn.Op{}, err
+	}
+	if line, ok := doc.(CasbinRule); ok {
+		line.ID = id
+		doc = line
+	}
+	if doc, err = a.withMetadata(doc, ptype, rule); err != nil {
+		return txn.Op{}, err
+	}
+
+	return txn.Op{
+		C:      a.collection.Name,
+		Id:     id,
+		Assert: txn.DocMissing,
+		Insert: doc,
+	}, nil
+}
+
+// RemovePolicyTxOps returns the txn operations removing a policy rule. There
+// is no operation if the rule is not stored. Like with RemovePolicy, the rule
+// is looked up with the collation set by WithCaseInsensitive, if any.
+func (a *adapter) RemovePolicyTxOps(sec string, ptype string, rule []string) ([]txn.Op, error) {
+	selector, err := a.selector(sec, ptype, rule)
+	if err != nil {
+		return nil, err
+	}
+
+	var docs []struct {
+		ID interface{} `bson:"_id"`
+	}
+	var name string
+	err = a.runCtx(context.Background(), "RemovePolicyTxOps", func(c *mgo.Collection) error {
+		name = c.Name
+		return a.find(c, selector).Select(bson.M{"_id": 1}).Limit(1).All(&docs)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var ops []txn.Op
+	for _, doc := range docs {
+		ops = append(ops, txn.Op{
+			C:      name,
+			Id:     doc.ID,
+			Assert: txn.DocExists,
+			Remove: true,
+		})
+	}
+	return ops, nil
+}
@@ -0,0 +1,207 @@
+// Copyright 2017 The casbin Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongodbadapter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+// ErrPolicyNotFound is returned when updating a rule which is not stored.
+var ErrPolicyNotFound = errors.New("mongodbadapter: policy rule not found")
+
+// UpdatePolicy replaces a stored rule with newRule in place, keeping its _id.
+// It returns ErrPolicyNotFound if oldRule is not stored. Only one copy of a
+// rule stored several times is updated.
+func (a *adapter) UpdatePolicy(sec string, ptype string, oldRule, newRule []string) error {
+	err := a.runCtx(context.Background(), "UpdatePolicy", func(c *mgo.Collection) error {
+		return a.updatePolicy(c, sec, ptype, oldRule, newRule)
+	})
+	return a.logChange(err, PolicyChange{Op: "UpdatePolicy", Sec: sec, PType: ptype, Rules: [][]string{oldRule}, NewRules: [][]string{newRule}})
+}
+
+func (a *adapter) updatePolicy(c *mgo.Collection, sec string, ptype string, oldRule, newRule []string) error {
+	selector, replacement, err := a.updatePair(sec, ptype, oldRule, newRule)
+	if err != nil {
+		return err
+	}
+
+	updated, err := a.updateOne(c, selector, replacement)
+	if err == nil && !updated {
+		return fmt.Errorf("%w: %s rule %v", ErrPolicyNotFound, ptype, oldRule)
+	}
+	return err
+}
+
+// UpdatePolicies replaces each of oldRules with the rule at the same position
+// in newRules, in a single request. The updates are applied in order but not
+// atomically: if some of oldRules are not stored, the others are still
+// updated and ErrPolicyNotFound is returned.
+func (a *adapter) UpdatePolicies(sec string, ptype string, oldRules, newRules [][]string) error {
+	err := a.runCtx(context.Background(), "UpdatePolicies", func(c *mgo.Collection) error {
+		return a.updatePolicies(c, sec, ptype, oldRules, newRules)
+	})
+	return a.logChange(err, PolicyChange{Op: "UpdatePolicies", Sec: sec, PType: ptype, Rules: oldRules, NewRules: newRules})
+}
+
+func (a *adapter) updatePolicies(c *mgo.Collection, sec string, ptype string, oldRules, newRules [][]string) error {
+	if len(oldRules) != len(newRules) {
+		return fmt.Errorf("mongodbadapter: %d old rules but %d new rules", len(oldRules), len(newRules))
+	}
+	if len(oldRules) == 0 {
+		return nil
+	}
+
+	selectors := make([]interface{}, len(oldRules))
+	replacements := make([]interface{}, len(oldRules))
+	for i := range oldRules {
+		selector, replacement, err := a.updatePair(sec, ptype, oldRules[i], newRules[i])
+		if err != nil {
+			return fmt.Errorf("mongodbadapter: rule %d (%v): %w", i, oldRules[i], err)
+		}
+		selectors[i], replacements[i] = selector, replacement
+	}
+
+	// A bulk update cannot use a collation, so the rules are then updated
+	// one at a time.
+	matched := 0
+	if a.collation != nil {
+		for i := range selectors {
+			updated, err := a.updateOne(c, selectors[i], replacements[i])
+			if err != nil {
+				return err
+			}
+			if updated {
+				matched++
+			}
+		}
+	} else {
+		bulk := c.Bulk()
+		for i := range selectors {
+			bulk.Update(selectors[i], replacements[i])
+		}
+		res, err := bulk.Run()
+		if err != nil {
+			return err
+		}
+		matched = res.Matched
+	}
+
+	if matched < len(oldRules) {
+		return fmt.Errorf("%w: %d of %d %s rules", ErrPolicyNotFound, len(oldRules)-matched, len(oldRules), ptype)
+	}
+	return nil
+}
+
+// updatePair returns the selector of oldRule and the document replacing it
+// with newRule. The replacement has no _id, so that the stored one is kept.
+func (a *adapter) updatePair(sec string, ptype string, oldRule, newRule []string) (interface{}, interface{}, error) {
+	selector, err := a.selector(sec, ptype, oldRule)
+	if err != nil {
+		return nil, nil, err
+	}
+	replacement, err := a.codec.Encode(sec, ptype, newRule)
+	if err != nil {
+		return nil, nil, err
+	}
+	replacement, err = a.withMetadata(replacement, ptype, newRule)
+	if err != nil {
+		return nil, nil, err
+	}
+	return selector, replacement, nil
+}
+
+// UpdateFilteredPolicies replaces the rules matched by the same arguments as
+// RemoveFilteredPolicy with newRules, e.g. every rule of a subject with its
+// recomputed rules, and returns the rules it matched. mgo cannot run the
+// change in a transaction, so it is done in the order that never leaves the
+// policy without the matched rules: the rules of newRules which are not
+// stored yet are inserted first, then the matched rules which are not part
+// of newRules are removed. Readers may briefly see both, and a failed removal
+// leaves both stored. Rules both matched and part of newRules are left as
+// they are.
+func (a *adapter) UpdateFilteredPolicies(sec string, ptype string, newRules [][]string, fieldIndex int, fieldValues ...string) ([][]string, error) {
+	var oldRules [][]string
+	err := a.runCtx(context.Background(), "UpdateFilteredPolicies", func(c *mgo.Collection) error {
+		var err error
+		oldRules, err = a.updateFilteredPolicies(c, sec, ptype, newRules, fieldIndex, fieldValues...)
+		return err
+	})
+	return oldRules, a.logChange(err, PolicyChange{Op: "UpdateFilteredPolicies", Sec: sec, PType: ptype, Rules: oldRules, NewRules: newRules, FieldIndex: fieldIndex, FieldValues: fieldValues})
+}
+
+func (a *adapter) updateFilteredPolicies(c *mgo.Collection, sec string, ptype string, newRules [][]string, fieldIndex int, fieldValues ...string) ([][]string, error) {
+	selector := a.renameFields(BuildFilterSelector(ptype, fieldIndex, fieldValues...))
+
+	var oldRules [][]string
+	stored := make(map[string][]interface{})
+	var raw bson.Raw
+	iter := a.find(c, selector).Iter()
+	for iter.Next(&raw) {
+		var doc struct {
+			ID interface{} `bson:"_id"`
+		}
+		if err := raw.Unmarshal(&doc); err != nil {
+			iter.Close()
+			return nil, err
+		}
+		_, rule, err := a.decode(raw)
+		if err != nil {
+			iter.Close()
+			return nil, err
+		}
+		oldRules = append(oldRules, rule)
+		key := ruleKey(ptype, rule)
+		stored[key] = append(stored[key], doc.ID)
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+
+	var docs []interface{}
+	for i, rule := range newRules {
+		key := ruleKey(ptype, rule)
+		if ids := stored[key]; len(ids) > 0 {
+			stored[key] = ids[1:]
+			continue
+		}
+		doc, err := a.encode(sec, ptype, rule)
+		if err != nil {
+			return nil, fmt.Errorf("mongodbadapter: rule %d (%v): %w", i, rule, err)
+		}
+		docs = append(docs, doc)
+	}
+
+	var removed []interface{}
+	for _, ids := range stored {
+		removed = append(removed, ids...)
+	}
+
+	if len(docs) > 0 {
+		if _, err := a.insert(c, docs...); err != nil {
+			return nil, err
+		}
+	}
+	if len(removed) > 0 {
+		if _, err := a.removeMatching(c, bson.M{"_id": bson.M{"$in": removed}}); err != nil {
+			return nil, err
+		}
+	}
+	return oldRules, nil
+}
@@ -0,0 +1,141 @@
+// Copyright 2017 The casbin Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongodbadapter
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+// upsertManagedFields are the fields the adapter may write besides the policy
+// type. upsert unsets those the new document lacks, so that e.g. the values
+// of a longer rule or the expiry time of a temporary rule do not survive
+// being replaced.
+var upsertManagedFields = []string{"v0", "v1", "v2", "v3", "v4", "v5", "vextra", expireAtField, checksumField, updatedAtField}
+
+// upsert stores the encoded rule doc in c, replacing the values of the rule
+// with the same policy type and upsert key if there is one, and reports
+// whether a rule was inserted or changed. The key fields form the selector,
+// every other field of doc is set and the managed fields doc lacks are unset,
+// so this relies on the codec storing values in the "v0" to "v5" fields, or
+// in the fields named with WithFieldNames.
+func (a *adapter) upsert(c *mgo.Collection, doc interface{}) (bool, error) {
+	data, err := bson.Marshal(doc)
+	if err != nil {
+		return false, err
+	}
+	var fields bson.D
+	if err := bson.Unmarshal(data, &fields); err != nil {
+		return false, err
+	}
+
+	keys := map[string]bool{a.fieldName("ptype"): true}
+	for _, i := range a.upsertKey {
+		keys[a.fieldName(fmt.Sprintf("v%d", i))] = true
+	}
+
+	selector := bson.M{}
+	set := bson.M{}
+	update := bson.M{}
+	present := make(map[string]bool, len(fields))
+	for _, field := range fields {
+		present[field.Name] = true
+		switch {
+		case field.Name == "_id":
+			// The id of an existing rule must not change.
+			update["$setOnInsert"] = bson.M{"_id": field.Value}
+		case keys[field.Name]:
+			selector[field.Name] = field.Value
+		default:
+			set[field.Name] = field.Value
+		}
+	}
+	if len(set) > 0 {
+		update["$set"] = set
+	}
+	unset := bson.M{}
+	for _, name := range upsertManagedFields {
+		if name = a.fieldName(name); !present[name] && !keys[name] {
+			unset[name] = ""
+		}
+	}
+	if len(unset) > 0 {
+		update["$unset"] = unset
+	}
+	if len(update) == 0 {
+		update["$setOnInsert"] = selector
+	}
+
+	info, err := c.Upsert(selector, update)
+	if err != nil {
+		return false, err
+	}
+	return info.UpsertedId != nil || info.Updated > 0, nil
+}
+
+// AddPolicyIfNotExists adds a policy rule to the storage unless it is already
+// stored, and reports whether it was added. The rule is upserted with the
+// selector matching exactly it, so a single round trip both checks and adds
+// it. Two concurrent calls may still both add the rule unless the adapter is
+// configured with WithUniqueIndex, in which case the one losing the race
+// reports that the rule was not added. An upsert cannot use a collation, so
+// with WithCaseInsensitive the rule is looked up first and then inserted.
+func (a *adapter) AddPolicyIfNotExists(sec string, ptype string, rule []string) (bool, error) {
+	added := false
+	err := a.runCtx(context.Background(), "AddPolicyIfNotExists", func(c *mgo.Collection) error {
+		var err error
+		added, err = a.addPolicyIfNotExists(c, sec, ptype, rule)
+		return err
+	})
+	if !added {
+		return false, err
+	}
+	return true, a.logChange(err, PolicyChange{Op: "AddPolicyIfNotExists", Sec: sec, PType: ptype, Rules: [][]string{rule}})
+}
+
+func (a *adapter) addPolicyIfNotExists(c *mgo.Collection, sec string, ptype string, rule []string) (bool, error) {
+	selector, err := a.selector(sec, ptype, rule)
+	if err != nil {
+		return false, err
+	}
+	doc, err := a.encode(sec, ptype, rule)
+	if err != nil {
+		return false, err
+	}
+
+	if a.collation != nil {
+		n, err := a.find(c, selector).Limit(1).Count()
+		if err != nil || n > 0 {
+			return false, err
+		}
+		err = c.Insert(doc)
+		if mgo.IsDup(err) {
+			return false, nil
+		}
+		return err == nil, err
+	}
+
+	info, err := c.Upsert(selector, bson.M{"$setOnInsert": doc})
+	if mgo.IsDup(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return info.UpsertedId != nil, nil
+}
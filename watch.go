@@ -0,0 +1,271 @@
+// Copyright 2017 The casbin Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongodbadapter
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+// watchMaxAwait bounds how long a change stream blocks waiting for events,
+// and therefore how long a watcher takes to notice its context is done.
+const watchMaxAwait = time.Second
+
+// WatchBackoff configures how watchers reopen their change stream after it
+// failed, e.g. during a failover or an outage. Successive attempts wait
+// exponentially longer, from Initial up to Max, each delay being randomly
+// shortened by up to half (jitter) so that many watchers do not reconnect in
+// lockstep. Zero fields take their default value.
+type WatchBackoff struct {
+	// Initial is the delay before the first attempt, 100ms by default.
+	Initial time.Duration
+	// Max caps the delay between attempts, 30s by default.
+	Max time.Duration
+	// MaxElapsed is how long the watcher keeps trying after the stream
+	// failed before giving up, 5 minutes by default. A negative value
+	// means forever.
+	MaxElapsed time.Duration
+	// OnGiveUp, if not nil, is called with the last error when the watcher
+	// gives up.
+	OnGiveUp func(error)
+}
+
+// defaultWatchBackoff is used by watchers unless WithWatchBackoff is given.
+var defaultWatchBackoff = WatchBackoff{
+	Initial:    100 * time.Millisecond,
+	Max:        30 * time.Second,
+	MaxElapsed: 5 * time.Minute,
+}
+
+// delay returns the time to wait before the given reconnection attempt,
+// counting from 0.
+func (b WatchBackoff) delay(attempt int) time.Duration {
+	d := b.Initial
+	for i := 0; i < attempt && d < b.Max; i++ {
+		d *= 2
+	}
+	if d > b.Max {
+		d = b.Max
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// withDefaults returns b with its zero fields set to their default value.
+func (b WatchBackoff) withDefaults() WatchBackoff {
+	if b.Initial <= 0 {
+		b.Initial = defaultWatchBackoff.Initial
+	}
+	if b.Max <= 0 {
+		b.Max = defaultWatchBackoff.Max
+	}
+	if b.MaxElapsed == 0 {
+		b.MaxElapsed = defaultWatchBackoff.MaxElapsed
+	}
+	return b
+}
+
+// changeEvent is the part of a change stream event the watchers look at.
+type changeEvent struct {
+	OperationType string `bson:"operationType"`
+	DocumentKey   struct {
+		ID interface{} `bson:"_id"`
+	} `bson:"documentKey"`
+	FullDocument *CasbinRule `bson:"fullDocument"`
+}
+
+// watch opens a change stream on the collection with the given pipeline and
+// passes every event to handle until handle returns false, ctx is done or the
+// stream cannot be reopened. Failed streams are reopened according to the
+// adapter's WatchBackoff, resuming after the last event seen. If opened is not
+// nil, it is called every time the stream has been opened.
+func (a *adapter) watch(ctx context.Context, pipeline interface{}, opened func(), handle func(changeEvent) bool) error {
+	if err := a.connect(); err != nil {
+		return err
+	}
+	ctx, done := a.track(ctx)
+	defer done()
+
+	session := a.session.Copy()
+	defer session.Close()
+	c := a.collection.With(session)
+
+	backoff := a.watchBackoff.withDefaults()
+	var resumeToken *bson.Raw
+	var failedAt time.Time
+	attempt := 0
+
+	for {
+		err := func() error {
+			stream, err := c.Watch(pipeline, mgo.ChangeStreamOptions{
+				FullDocument:   mgo.UpdateLookup,
+				MaxAwaitTimeMS: watchMaxAwait,
+				ResumeAfter:    resumeToken,
+			})
+			if err != nil {
+				return err
+			}
+			defer stream.Close()
+			if opened != nil {
+				opened()
+			}
+
+			for {
+				if err := ctx.Err(); err != nil {
+					return err
+				}
+
+				var event changeEvent
+				if !stream.Next(&event) {
+					if stream.Timeout() {
+						continue
+					}
+					if err := stream.Err(); err != nil {
+						return err
+					}
+					return fmt.Errorf("mongodbadapter: change stream closed")
+				}
+				resumeToken = stream.ResumeToken()
+				failedAt, attempt = time.Time{}, 0
+
+				if !handle(event) {
+					return nil
+				}
+			}
+		}()
+		if err == nil || ctx.Err() != nil {
+			return err
+		}
+
+		if failedAt.IsZero() {
+			failedAt = time.Now()
+		}
+		if backoff.MaxElapsed >= 0 && time.Since(failedAt) > backoff.MaxElapsed {
+			if backoff.OnGiveUp != nil {
+				backoff.OnGiveUp(err)
+			}
+			return err
+		}
+
+		timer := time.NewTimer(backoff.delay(attempt))
+		attempt++
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+		session.Refresh()
+	}
+}
+
+// WatchSubject calls cb every time a rule of the given policy type and
+// subject (v0) is added, changed or removed, until ctx is done or the adapter
+// is closed. It blocks meanwhile and returns the context's error once it
+// stops, or the stream's error if it could not be reopened (see
+// WithWatchBackoff). Change streams require
+// a replica set or a sharded cluster.
+//
+// Removal events only carry the id of the removed document, so WatchSubject
+// keeps track of the ids of the subject's rules to recognize them. When the
+// collection is dropped or renamed, e.g. by SavePolicy, cb is called a last
+// time and WatchSubject returns nil, since the stream cannot continue.
+func (a *adapter) WatchSubject(ctx context.Context, ptype, subject string, cb func()) error {
+	if err := a.connect(); err != nil {
+		return err
+	}
+	var docs []struct {
+		ID interface{} `bson:"_id"`
+	}
+	if err := a.collection.Find(bson.M{"ptype": ptype, "v0": subject}).Select(bson.M{"_id": 1}).All(&docs); err != nil {
+		return err
+	}
+	ids := make(map[string]struct{}, len(docs))
+	for _, doc := range docs {
+		ids[fmt.Sprint(doc.ID)] = struct{}{}
+	}
+
+	pipeline := []bson.M{{"$match": bson.M{"$or": []bson.M{
+		{"fullDocument.ptype": ptype, "fullDocument.v0": subject},
+		{"operationType": bson.M{"$ne": "insert"}},
+	}}}}
+	return a.watch(ctx, pipeline, nil, func(event changeEvent) bool {
+		switch event.OperationType {
+		case "drop", "rename", "dropDatabase", "invalidate":
+			cb()
+			return false
+		}
+
+		id := fmt.Sprint(event.DocumentKey.ID)
+		doc := event.FullDocument
+		if doc != nil && doc.PType == ptype && doc.V0 == subject {
+			ids[id] = struct{}{}
+			cb()
+		} else if _, ok := ids[id]; ok {
+			delete(ids, id)
+			cb()
+		}
+		return true
+	})
+}
+
+// StartWatch calls callback, from a background goroutine, every time a rule
+// is added, changed or removed by any adapter sharing the collection, so that
+// each enforcer can reload its policy. Change streams require a replica set
+// or a sharded cluster.
+//
+// The watch goes on until ctx is done or the adapter is closed. Failed
+// streams are reopened according to WithWatchBackoff; once the watch gives up
+// its error is passed to the backoff's OnGiveUp and returned by Close. When
+// the collection is dropped or renamed, e.g. by SavePolicy, a new stream is
+// opened on the new collection and callback is called once it is open, so
+// that no rule written after the reload goes unnoticed.
+func (a *adapter) StartWatch(ctx context.Context, callback func()) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	a.goBackground(ctx, func(ctx context.Context) error {
+		// A drop, rename or dropDatabase event is followed by an invalidate
+		// event closing the stream. Callback is only called once the next
+		// stream is open, since rules written in between would be missed.
+		invalidated := false
+		opened := func() {
+			if invalidated {
+				invalidated = false
+				callback()
+			}
+		}
+		for {
+			err := a.watch(ctx, []bson.M{}, opened, func(event changeEvent) bool {
+				switch event.OperationType {
+				case "drop", "rename", "dropDatabase", "invalidate":
+					invalidated = true
+					return event.OperationType != "invalidate"
+				}
+				callback()
+				return true
+			})
+			if err != nil {
+				return err
+			}
+		}
+	})
+	return nil
+}